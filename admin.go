@@ -0,0 +1,225 @@
+package bypass
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+	"github.com/miekg/dns"
+)
+
+// admin serves JSON reports about routing decisions, rules and upstreams over HTTP:
+//
+//	/route?name=NAME[&client=IP]  how a query for NAME from IP would be handled
+//	/rules                        rule version and entry counts per source
+//	/upstreams                    groups with the health and pool sizes of their proxies
+//	/sets                         the routing sets, if they are collected
+type admin struct {
+	addr string
+	b    *Bypass
+	ln   net.Listener
+}
+
+func (a *admin) startup() error {
+	ln, err := reuseport.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	a.ln = ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/route", a.route)
+	mux.HandleFunc("/rules", a.rules)
+	mux.HandleFunc("/upstreams", a.upstreams)
+	mux.HandleFunc("/sets", a.sets)
+	go func() { http.Serve(a.ln, mux) }()
+	return nil
+}
+
+func (a *admin) shutdown() error {
+	if a.ln == nil {
+		return nil
+	}
+	return a.ln.Close()
+}
+
+// routeReport explains how a query would be handled.
+type routeReport struct {
+	Name    string   `json:"name"`
+	Client  string   `json:"client,omitempty"`
+	Nets    []string `json:"client_nets,omitempty"` // of the client block whose rules are used
+	Version uint64   `json:"rules_version"`
+	// Decision is one of route, default, excluded, apex or out_of_zone.
+	Decision string   `json:"decision"`
+	Rules    []string `json:"rules,omitempty"`  // of the matching route
+	Source   string   `json:"source,omitempty"` // the rule the matching entry came from, e.g. geosite:cn
+	Rule     string   `json:"rule,omitempty"`   // the matching entry, e.g. domain:example.cn
+	Action   string   `json:"action"`
+	Group    string   `json:"group,omitempty"`
+}
+
+func (a *admin) route(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, a.b.explain(dns.Fqdn(strings.ToLower(name)), r.URL.Query().Get("client")))
+}
+
+// explain reports how a query for name from the client with address ip would be handled.
+func (b *Bypass) explain(name, ip string) routeReport {
+	rs := b.snapshot()
+	r := routeReport{Name: name, Client: ip, Version: rs.version, Action: actionRoute.String()}
+	if cr := b.clientRules(ip); cr != nil {
+		for _, n := range cr.nets {
+			r.Nets = append(r.Nets, n.String())
+		}
+	}
+
+	m := b.matchName(name, ip, rs)
+	rt, def := m.rt, m.def
+	switch {
+	case rt == apexRoute:
+		r.Decision, r.Group = "apex", rt.group
+	case rt != nil:
+		r.Decision, r.Rules, r.Action = "route", rt.rules, rt.action.String()
+		r.Rule, r.Source, _ = rs.lists[rt].Match(name)
+		if rt.action == actionRoute {
+			r.Group = rt.group
+		}
+	case !plugin.Name(b.from).Matches(name):
+		r.Decision, r.Group = "out_of_zone", def
+	default:
+		r.Decision, r.Group = "default", def
+		if rule, source, ok := rs.exclude.Match(name); ok {
+			r.Decision, r.Rule, r.Source = "excluded", rule, source
+		}
+	}
+	return r
+}
+
+// rulesReport describes the active rule set.
+type rulesReport struct {
+	Version uint64         `json:"version"`
+	Loaded  time.Time      `json:"loaded"`
+	Routes  []routeCounts  `json:"routes"`
+	Exclude map[string]int `json:"exclude"`
+}
+
+// routeCounts holds the number of domain list entries per source of a route.
+type routeCounts struct {
+	Nets   []string       `json:"client_nets,omitempty"`
+	Rules  []string       `json:"rules"`
+	Action string         `json:"action"`
+	Group  string         `json:"group,omitempty"`
+	Counts map[string]int `json:"counts"`
+}
+
+func (a *admin) rules(w http.ResponseWriter, r *http.Request) {
+	rs := a.b.snapshot()
+	report := rulesReport{Version: rs.version, Loaded: rs.loaded, Routes: []routeCounts{}, Exclude: rs.exclude.Counts()}
+	add := func(nets []*net.IPNet, routes []*route) {
+		for _, rt := range routes {
+			rc := routeCounts{Rules: rt.rules, Action: rt.action.String(), Counts: map[string]int{}}
+			for _, n := range nets {
+				rc.Nets = append(rc.Nets, n.String())
+			}
+			if rt.action == actionRoute {
+				rc.Group = rt.group
+			}
+			if l, ok := rs.lists[rt]; ok {
+				rc.Counts = l.Counts()
+			}
+			report.Routes = append(report.Routes, rc)
+		}
+	}
+	add(nil, a.b.routes)
+	for _, cr := range a.b.clients {
+		add(cr.nets, cr.routes)
+	}
+	writeJSON(w, report)
+}
+
+// groupReport describes an upstream group.
+type groupReport struct {
+	Name       string        `json:"name"`
+	Policy     string        `json:"policy"`
+	MaxFails   uint32        `json:"max_fails"`
+	Expire     string        `json:"expire"`
+	ServerName string        `json:"tls_servername,omitempty"`
+	ForceTCP   bool          `json:"force_tcp,omitempty"`
+	PreferUDP  bool          `json:"prefer_udp,omitempty"`
+	Via        string        `json:"via,omitempty"`
+	Fallback   string        `json:"fallback,omitempty"`
+	BogusIP    string        `json:"bogus_ip,omitempty"` // the action for bogus answers
+	Proxies    []proxyReport `json:"proxies"`
+}
+
+// proxyReport describes the health and connection pool of a proxy.
+type proxyReport struct {
+	Addr      string         `json:"addr"`
+	Transport string         `json:"transport"`
+	Fails     uint32         `json:"fails"`
+	Down      bool           `json:"down"`
+	Pool      map[string]int `json:"pool"`
+}
+
+func (a *admin) upstreams(w http.ResponseWriter, r *http.Request) {
+	up := a.b.upstream()
+	report := []groupReport{}
+	for _, g := range up.groups {
+		gr := groupReport{
+			Name:       g.name,
+			Policy:     g.p.String(),
+			MaxFails:   g.maxfails,
+			Expire:     g.expire.String(),
+			ServerName: g.tlsServerName,
+			ForceTCP:   g.opts.forceTCP,
+			PreferUDP:  g.opts.preferUDP,
+			Proxies:    []proxyReport{},
+		}
+		if g.via != nil {
+			gr.Via = g.via.String()
+		}
+		if g.next != nil {
+			gr.Fallback = g.next.name
+		}
+		if g.bogus != nil {
+			gr.BogusIP = g.bogus.action
+		}
+		for i, p := range g.proxies {
+			gr.Proxies = append(gr.Proxies, proxyReport{
+				Addr:      p.addr,
+				Transport: g.transports[i],
+				Fails:     atomic.LoadUint32(&p.fails),
+				Down:      p.Down(g.maxfails),
+				Pool:      p.transport.Sizes(),
+			})
+		}
+		report = append(report, gr)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Name < report[j].Name })
+	writeJSON(w, report)
+}
+
+func (a *admin) sets(w http.ResponseWriter, r *http.Request) {
+	if a.b.sets == nil {
+		http.Error(w, "routing sets are not collected", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, a.b.sets.snapshot())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
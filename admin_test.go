@@ -0,0 +1,103 @@
+package bypass
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+)
+
+func adminTestBypass(t *testing.T) *Bypass {
+	t.Helper()
+	c := caddy.NewTestController("dns", `bypass example.org 127.0.0.1:5301 {
+    forward 127.0.0.1:5302
+    group domestic 127.0.0.1:5303
+    route domain:cn.example.org domestic
+    block full:ads.example.org
+    exclude domain:www.cn.example.org
+    client 10.0.0.0/8 {
+        route keyword:lan pass
+        default domestic
+    }
+}`)
+	b, err := parseBypass(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestExplain(t *testing.T) {
+	b := adminTestBypass(t)
+	tests := []struct {
+		name, client string
+		want         routeReport
+	}{
+		{"a.cn.example.org.", "192.0.2.1", routeReport{
+			Decision: "route", Rules: []string{"domain:cn.example.org"}, Source: "domain:cn.example.org",
+			Rule: "domain:cn.example.org", Action: "route", Group: "domestic",
+		}},
+		{"ads.example.org.", "192.0.2.1", routeReport{
+			Decision: "route", Rules: []string{"full:ads.example.org"}, Source: "full:ads.example.org",
+			Rule: "full:ads.example.org", Action: "nxdomain",
+		}},
+		{"www.example.org.", "192.0.2.1", routeReport{Decision: "default", Action: "route", Group: forwardGroup}},
+		{"www.cn.example.org.", "192.0.2.1", routeReport{
+			Decision: "excluded", Source: "domain:www.cn.example.org", Rule: "domain:www.cn.example.org",
+			Action: "route", Group: forwardGroup,
+		}},
+		{"example.org.", "192.0.2.1", routeReport{Decision: "apex", Action: "route", Group: passGroup}},
+		{"example.com.", "192.0.2.1", routeReport{Decision: "out_of_zone", Action: "route", Group: forwardGroup}},
+		// The client block's routes and default replace the plugin's.
+		{"lan.example.org.", "10.1.2.3", routeReport{
+			Nets: []string{"10.0.0.0/8"}, Decision: "route", Rules: []string{"keyword:lan"}, Source: "keyword:lan",
+			Rule: "keyword:lan", Action: "route", Group: passGroup,
+		}},
+		{"a.cn.example.org.", "10.1.2.3", routeReport{Nets: []string{"10.0.0.0/8"}, Decision: "default", Action: "route", Group: "domestic"}},
+	}
+	for _, tc := range tests {
+		tc.want.Name, tc.want.Client, tc.want.Version = tc.name, tc.client, 1
+		if got := b.explain(tc.name, tc.client); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s from %s: got %+v, want %+v", tc.name, tc.client, got, tc.want)
+		}
+	}
+}
+
+func TestAdminRoute(t *testing.T) {
+	a := &admin{b: adminTestBypass(t)}
+	rec := httptest.NewRecorder()
+	a.route(rec, httptest.NewRequest("GET", "/route?name=A.CN.example.org&client=192.0.2.1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %q", ct)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"name":          "a.cn.example.org.",
+		"client":        "192.0.2.1",
+		"rules_version": float64(1),
+		"decision":      "route",
+		"rules":         []interface{}{"domain:cn.example.org"},
+		"source":        "domain:cn.example.org",
+		"rule":          "domain:cn.example.org",
+		"action":        "route",
+		"group":         "domestic",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	a.route(rec, httptest.NewRequest("GET", "/route", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("without a name: got status %d", rec.Code)
+	}
+}
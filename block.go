@@ -0,0 +1,82 @@
+package bypass
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// action is what happens to a query that matches a route.
+type action int
+
+const (
+	actionRoute    action = iota // send to the route's group
+	actionNXDomain               // answer NXDOMAIN
+	actionNoData                 // answer NOERROR without records
+	actionSinkhole               // answer 0.0.0.0 or ::
+)
+
+var actions = map[string]action{
+	"route":    actionRoute,
+	"nxdomain": actionNXDomain,
+	"nodata":   actionNoData,
+	"sinkhole": actionSinkhole,
+}
+
+func (a action) String() string {
+	for s, x := range actions {
+		if x == a {
+			return s
+		}
+	}
+	return "unknown"
+}
+
+// block answers the query locally according to a. Answers without records carry an SOA record so
+// resolvers downstream can cache them.
+func (b *Bypass) block(w dns.ResponseWriter, state request.Request, a action) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+
+	switch a {
+	case actionNXDomain:
+		m.Rcode = dns.RcodeNameError
+	case actionSinkhole:
+		hdr := dns.RR_Header{Name: state.QName(), Class: dns.ClassINET, Ttl: blockTTL}
+		switch state.QType() {
+		case dns.TypeA:
+			hdr.Rrtype = dns.TypeA
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		case dns.TypeAAAA:
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{blockSOA(state.QName())}
+	}
+
+	BlockCount.WithLabelValues(a.String()).Add(1)
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+// blockSOA returns the SOA record for a negative answer about name. It is owned by name itself, so
+// the answer is only cached for the blocked name.
+func blockSOA(name string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: blockTTL},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster.localhost.",
+		Serial:  1,
+		Refresh: blockTTL,
+		Retry:   blockTTL,
+		Expire:  blockTTL,
+		Minttl:  blockTTL,
+	}
+}
+
+// blockTTL is the TTL of synthesized sinkhole records and of negative answers.
+const blockTTL = 60
@@ -0,0 +1,62 @@
+package bypass
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestBlock(t *testing.T) {
+	tests := []struct {
+		action action
+		qtype  uint16
+		rcode  int
+		answer string // the address answered, "" for none
+	}{
+		{actionNXDomain, dns.TypeA, dns.RcodeNameError, ""},
+		{actionNoData, dns.TypeA, dns.RcodeSuccess, ""},
+		{actionSinkhole, dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{actionSinkhole, dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{actionSinkhole, dns.TypeMX, dns.RcodeSuccess, ""},
+	}
+	b := New()
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("ads.example.org.", tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := b.block(rec, request.Request{W: rec, Req: m}, tc.action); err != nil {
+			t.Fatal(err)
+		}
+		ret, what := rec.Msg, tc.action.String()+" "+dns.TypeToString[tc.qtype]
+		if ret.Rcode != tc.rcode || !ret.Authoritative || ret.Id != m.Id {
+			t.Errorf("%s: got %s, authoritative %v", what, dns.RcodeToString[ret.Rcode], ret.Authoritative)
+		}
+		if tc.answer != "" {
+			if len(ret.Answer) != 1 || len(ret.Ns) != 0 {
+				t.Errorf("%s: got %d answers and %d authority records", what, len(ret.Answer), len(ret.Ns))
+				continue
+			}
+			var ip string
+			switch rr := ret.Answer[0].(type) {
+			case *dns.A:
+				ip = rr.A.String()
+			case *dns.AAAA:
+				ip = rr.AAAA.String()
+			}
+			if ip != tc.answer || ret.Answer[0].Header().Ttl != blockTTL {
+				t.Errorf("%s: got %s", what, ret.Answer[0])
+			}
+			continue
+		}
+		if len(ret.Answer) != 0 || len(ret.Ns) != 1 {
+			t.Errorf("%s: got %d answers and %d authority records", what, len(ret.Answer), len(ret.Ns))
+			continue
+		}
+		if soa, ok := ret.Ns[0].(*dns.SOA); !ok || soa.Hdr.Name != "ads.example.org." || soa.Minttl != blockTTL {
+			t.Errorf("%s: got authority %s", what, ret.Ns[0])
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package bypass
+
+import (
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// bogusFilter catches answers that contain an address resolvers use to hijack NXDOMAIN, like the ad
+// servers of some ISPs.
+type bogusFilter struct {
+	set    *IPSet
+	action string // bogusNXDomain, bogusRetry or the name of the group to ask instead
+}
+
+// parseBogusIP parses a bogus_ip property:
+//
+//	bogus_ip nxdomain|retry|GROUP IP|CIDR|FILE...
+//
+// nxdomain turns the answer back into NXDOMAIN, retry asks the next upstream of the group and GROUP
+// asks that group, and the groups it falls back to, instead. When no upstream gives a clean answer
+// the result is NXDOMAIN as well. A rewritten answer is sent to dnstap after the bogus one.
+func parseBogusIP(c *caddyfile.Dispenser) (*bogusFilter, error) {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return nil, c.ArgErr()
+	}
+	set, err := parseIPList(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &bogusFilter{set: set, action: args[0]}, nil
+}
+
+// nxdomain returns the NXDOMAIN reply req should have gotten instead of ret.
+func (f *bogusFilter) nxdomain(req, ret *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeNameError)
+	m.RecursionAvailable = ret.RecursionAvailable
+	return m
+}
+
+const (
+	bogusNXDomain = "nxdomain"
+	bogusRetry    = "retry"
+)
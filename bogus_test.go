@@ -0,0 +1,132 @@
+package bypass
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// udpServer starts a DNS server that answers with the address ip.
+func udpServer(t *testing.T, ip string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(reply(r, ip))
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestBogusIP(t *testing.T) {
+	hijack, clean := udpServer(t, "203.0.113.7"), udpServer(t, "192.0.2.1")
+
+	tests := []struct {
+		group, from string
+		rcode       int
+	}{
+		{"pass", "pass", dns.RcodeNameError},     // rewritten
+		{"forward", "forward", dns.RcodeSuccess}, // retried on the next upstream
+		{"isp", "other", dns.RcodeSuccess},       // asked the other group
+		{"lone", "lone", dns.RcodeNameError},     // no clean upstream left to retry
+	}
+	cfg, err := parseUpstreams(`group pass ` + hijack + ` {
+    bogus_ip nxdomain 203.0.113.0/24
+}
+group forward ` + hijack + ` ` + clean + ` {
+    policy sequential
+    bogus_ip retry 203.0.113.7
+}
+group isp ` + hijack + ` {
+    bogus_ip other 203.0.113.7
+}
+group other ` + clean + `
+group lone ` + hijack + ` {
+    bogus_ip retry 203.0.113.7
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New()
+	up := cfg.build(nil)
+	if err := b.checkGroups(up.groups); err != nil {
+		t.Fatal(err)
+	}
+	b.up.Store(up)
+	for _, p := range up.proxies {
+		p.start(hcInterval)
+		defer p.close()
+	}
+
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("nonexistent.example.org.", dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: m}
+		ret, from, _, err := b.exchange(context.Background(), state, up.groups[tc.group], defaultTimeout)
+		if err != nil {
+			t.Errorf("%s: %s", tc.group, err)
+			continue
+		}
+		if ret.Rcode != tc.rcode || (tc.rcode == dns.RcodeSuccess) != (len(ret.Answer) == 1) {
+			t.Errorf("%s: got %s with %d answers", tc.group, dns.RcodeToString[ret.Rcode], len(ret.Answer))
+		}
+		if from.name != tc.from {
+			t.Errorf("%s: answered by %s, want %s", tc.group, from.name, tc.from)
+		}
+	}
+
+	// The NXDOMAIN that replaces the bogus answer is tapped after it.
+	tapper := &recordingTapper{}
+	m := new(dns.Msg)
+	m.SetQuestion("nonexistent.example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+	if _, _, taperr, _ := b.exchange(dnstap.ContextWithTapper(context.Background(), tapper), state, up.groups[passGroup], defaultTimeout); taperr != nil {
+		t.Fatal(taperr)
+	}
+	var rcodes []string
+	for _, tm := range tapper.msgs {
+		if tm.ResponseMessage == nil {
+			continue
+		}
+		ret := new(dns.Msg)
+		if err := ret.Unpack(tm.ResponseMessage); err != nil {
+			t.Fatal(err)
+		}
+		rcodes = append(rcodes, dns.RcodeToString[ret.Rcode])
+	}
+	if len(rcodes) != 2 || rcodes[0] != "NOERROR" || rcodes[1] != "NXDOMAIN" {
+		t.Errorf("tapped responses %v, want the bogus answer and the NXDOMAIN", rcodes)
+	}
+
+	// A group that sends bogus answers on can't have them sent on again.
+	up.groups["other"].bogus = &bogusFilter{action: "isp"}
+	up.groups["other"].bogusGroup = up.groups["isp"]
+	if err := b.checkGroups(up.groups); err == nil {
+		t.Error("expected error for bogus_ip loop")
+	}
+}
+
+// recordingTapper keeps the messages sent to dnstap.
+type recordingTapper struct {
+	mu   sync.Mutex
+	msgs []*tap.Message
+}
+
+func (t *recordingTapper) TapMessage(m *tap.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.msgs = append(t.msgs, m)
+}
+
+func (t *recordingTapper) Pack() bool { return true }
@@ -2,13 +2,11 @@ package bypass
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
-	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/caddyserver/caddy"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/debug"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
@@ -18,30 +16,40 @@ import (
 
 var log = clog.NewWithPlugin("bypass")
 
-//Bypass ...
+// Bypass ...
 type Bypass struct {
 	concurrent int64 // atomic counters need to be first in struct for proper alignment
 
-	pass       []*Proxy
-	forward    []*Proxy
-	p          Policy
+	cfg          *upstreamConfig // upstream properties of the Corefile
+	upstreamFile string          // optional file with more upstream properties, reloaded on change
+	up           atomic.Value    // *upstreams built from cfg and upstreamFile
+
+	routes     []*route
+	def        string // group for names that match no route
+	clients    []*clientRules
 	hcInterval time.Duration
 	geosite    string
-	domains    []string
-	include    *DomainList
+	excludes   []string
+	geoip      string
+	verify     []string
+
+	rules    atomic.Value      // *ruleSet, replaced as a whole on reload
+	reloadMu sync.Mutex        // serializes rule set reloads
+	sizes    map[[2]string]int // entries per list and category last set in RuleSetSize, under reloadMu
 
-	from           string
-	domainChecksum string
-	dur            time.Duration
+	race           bool
+	passTimeout    time.Duration
+	forwardTimeout time.Duration
 
-	opts options // also here for testing
+	from     string
+	dur      time.Duration // polling interval of the rule files
+	debounce time.Duration // quiet time after a file notification before reloading
 
-	tlsConfig     *tls.Config
-	tlsServerName string
-	maxfails      uint32
-	expire        time.Duration
 	maxConcurrent int64
 
+	admin *admin       // nil unless the admin API is enabled
+	sets  *routingSets // nil unless routing sets are collected
+
 	// ErrLimitExceeded indicates that a query was rejected because the number of concurrent queries has exceeded
 	// the maximum allowed (maxConcurrent)
 	ErrLimitExceeded error
@@ -52,27 +60,50 @@ type Bypass struct {
 
 // New returns a new Bypass.
 func New() *Bypass {
-	b := &Bypass{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, p: new(random), from: ".", hcInterval: hcInterval, quit: make(chan bool), dur: defaultDuraiton, opts: options{forceTCP: false, preferUDP: false, hcRecursionDesired: true}}
+	b := &Bypass{cfg: newUpstreamConfig(), def: forwardGroup, from: ".", hcInterval: hcInterval, passTimeout: defaultTimeout, forwardTimeout: defaultTimeout, quit: make(chan bool), dur: defaultDuraiton, debounce: defaultDebounce}
+	b.rules.Store(newRuleSet())
+	b.up.Store(b.cfg.build(nil))
 	return b
 }
 
 // SetPass appends p to the proxy list and starts healthchecking.
-func (b *Bypass) SetPass(p *Proxy) {
-	b.pass = append(b.pass, p)
-	p.start(b.hcInterval)
-}
+func (b *Bypass) SetPass(p *Proxy) { b.setGroup(passGroup, p) }
 
 // SetForward appends p to the proxy list and starts healthchecking.
-func (b *Bypass) SetForward(p *Proxy) {
-	b.forward = append(b.forward, p)
+func (b *Bypass) SetForward(p *Proxy) { b.setGroup(forwardGroup, p) }
+
+// setGroup publishes a copy of the upstreams with p appended to group name.
+func (b *Bypass) setGroup(name string, p *Proxy) {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+
+	up := b.upstream().clone()
+	g, ok := up.groups[name]
+	if !ok {
+		g = NewGroup(name)
+		g.p, g.upstreamOptions = b.cfg.p, g.upstreamOptions.inherit(b.cfg.upstreamOptions)
+		up.groups[name] = g
+	}
+	g.addrs = append(g.addrs, p.addr)
+	g.transports = append(g.transports, "")
+	g.proxies = append(g.proxies, p)
+	up.proxies[g.key(p.addr, "")] = p
 	p.start(b.hcInterval)
+	b.up.Store(up)
 }
 
 // LenPass returns the number of configured proxies.
-func (b *Bypass) LenPass() int { return len(b.pass) }
+func (b *Bypass) LenPass() int { return b.lenGroup(passGroup) }
 
 // LenForward returns the number of configured proxies.
-func (b *Bypass) LenForward() int { return len(b.forward) }
+func (b *Bypass) LenForward() int { return b.lenGroup(forwardGroup) }
+
+func (b *Bypass) lenGroup(name string) int {
+	if g, ok := b.upstream().groups[name]; ok {
+		return g.Len()
+	}
+	return 0
+}
 
 // Name implements plugin.Handler.
 func (b *Bypass) Name() string { return "bypass" }
@@ -80,7 +111,19 @@ func (b *Bypass) Name() string { return "bypass" }
 // ServeDNS implements plugin.Handler.
 func (b *Bypass) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
-	match := b.match(state)
+	// Stick to the rules and upstreams we start with, even if a reload replaces them meanwhile.
+	rs, up := b.snapshot(), b.upstream()
+	m := b.match(state, rs)
+	rt := m.rt
+	RouteCount.WithLabelValues(m.labels()).Add(1)
+	if rt != nil && rt.action != actionRoute {
+		return b.block(w, state, rt.action)
+	}
+	def := up.groups[m.def]
+	g, match := def, rt != nil
+	if match {
+		g = up.groups[rt.group]
+	}
 	if b.maxConcurrent > 0 {
 		count := atomic.AddInt64(&(b.concurrent), 1)
 		defer atomic.AddInt64(&(b.concurrent), -1)
@@ -89,19 +132,119 @@ func (b *Bypass) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 			return dns.RcodeServerFailure, b.ErrLimitExceeded
 		}
 	}
-	fails := 0
-	var upstreamErr error
-	i := 0
-	var list []*Proxy
-	if match {
-		list = b.ListPass()
-	} else {
-		list = b.ListForward()
+
+	var (
+		ret    *dns.Msg
+		from   *Group // the group that answered
+		taperr error
+		err    error
+	)
+	switch {
+	case match && g.name != passGroup:
+		// Explicitly routed to a group other than pass, verify and race don't apply.
+		ret, from, taperr, err = b.resolve(ctx, state, g, defaultTimeout)
+	case m.clientDef:
+		// A client block with a default group of its own gets exactly the groups it asks for,
+		// verify and race only apply along with the plugin's default group.
+		ret, from, taperr, err = b.resolve(ctx, state, g, defaultTimeout)
+	case b.race && b.verifiable(state, rs):
+		ret, from, taperr, err = b.raceGroups(ctx, state, rs, up.groups[passGroup], def, match)
+	default:
+		ret, from, taperr, err = b.serial(ctx, state, rs, up.groups[passGroup], g, def)
+	}
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+
+	// Check if the reply is correct; if not return FormErr.
+	if !state.Match(ret) {
+		debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, state.QName(), state.QType())
+
+		formerr := new(dns.Msg)
+		formerr.SetRcode(state.Req, dns.RcodeFormatError)
+		w.WriteMsg(formerr)
+		return 0, taperr
+	}
+
+	if b.sets != nil {
+		b.sets.add(from.name, ret)
+	}
+	w.WriteMsg(ret)
+	return 0, taperr
+}
+
+// serial asks group g. When a verify set is configured the pass group is asked first and its answer
+// is replaced by the default group's if it resolves outside the set. The group that answered is
+// returned in from.
+func (b *Bypass) serial(ctx context.Context, state request.Request, rs *ruleSet, pass, g, def *Group) (ret *dns.Msg, from *Group, taperr, err error) {
+	verify := rs.verify != nil && b.verifiable(state, rs)
+	if verify {
+		g = pass
+	}
+
+	ret, from, taperr, err = b.resolve(ctx, state, g, defaultTimeout)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	deadline := time.Now().Add(defaultTimeout)
+
+	if verify && !rs.verify.Domestic(ret) {
+		// The pass answer resolves outside the verify set, ask the forward group instead.
+		VerifyFallbackCount.Add(1)
+		fret, ffrom, ftaperr, ferr := b.resolve(ctx, state, def, defaultTimeout)
+		if ferr == nil {
+			return fret, ffrom, ftaperr, nil
+		}
+		log.Debugf("Forward group failed for %s, keeping pass answer: %s", state.Name(), ferr)
+	}
+	return ret, from, taperr, nil
+}
+
+// resolve asks g and, when every upstream of g is down or failed, the groups it falls back to in
+// turn. The group that answered is returned in from.
+func (b *Bypass) resolve(ctx context.Context, state request.Request, g *Group, timeout time.Duration) (ret *dns.Msg, from *Group, taperr, err error) {
+	for {
+		ret, from, taperr, err = b.exchange(ctx, state, g, timeout)
+		if err == nil || g.next == nil {
+			return ret, from, taperr, err
+		}
+		log.Debugf("Group %s failed for %s, falling back to %s: %s", g.name, state.Name(), g.next.name, err)
+		FallbackCount.WithLabelValues(g.name, g.next.name).Add(1)
+		g = g.next
+	}
+}
+
+// exchange sends the query to the proxies of g until one of them answers or timeout expires. A
+// group with a fallback gives up after trying each of its proxies once, or right away when they are
+// all down. The group that answered, g or the one bogus answers are sent to, is returned in from.
+// Errors from dnstap reporting are returned in taperr, separate from the upstream error.
+func (b *Bypass) exchange(ctx context.Context, state request.Request, g *Group, timeout time.Duration) (ret *dns.Msg, from *Group, taperr, err error) {
+	orig := state
+	// Apply the group's EDNS Client Subnet option to a copy of the request.
+	state, undo := g.ecs.apply(state)
+	defer func() {
+		if ret != nil {
+			undo.restore(ret)
+		}
+	}()
+
+	list := g.list()
+	if len(list) == 0 {
+		return nil, nil, nil, ErrNoHealthy
+	}
+	fails, bogus := 0, 0
+	var (
+		upstreamErr error
+		lastBogus   *dns.Msg // the last answer with a bogus address
+		bogusProxy  *Proxy   // and the proxy it came from
+	)
+	i := 0
+	deadline := time.Now().Add(timeout)
 	start := time.Now()
 	for time.Now().Before(deadline) {
 		if i >= len(list) {
+			if g.next != nil {
+				break
+			}
 			// reached the end of list, reset to begin
 			i = 0
 			fails = 0
@@ -109,11 +252,14 @@ func (b *Bypass) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 
 		proxy := list[i]
 		i++
-		if proxy.Down(b.maxfails) {
+		if proxy.Down(g.maxfails) {
 			fails++
 			if fails < len(list) {
 				continue
 			}
+			if g.next != nil {
+				return nil, nil, nil, ErrNoHealthy
+			}
 			// All upstream proxies are dead, assume healthcheck is completely broken and randomly
 			// select an upstream to connect to.
 			r := new(random)
@@ -122,11 +268,7 @@ func (b *Bypass) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 			HealthcheckBrokenCount.Add(1)
 		}
 
-		var (
-			ret *dns.Msg
-			err error
-		)
-		opts := b.opts
+		opts := g.opts
 		for {
 			ret, err = proxy.Connect(ctx, state, opts)
 			if err == ErrCachedClosed { // Remote side closed conn, can only happen with TCP.
@@ -140,13 +282,13 @@ func (b *Bypass) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 			break
 		}
 
-		taperr := toDnstap(ctx, proxy.addr, b, state, ret, start)
+		taperr = toDnstap(ctx, proxy, g.opts, state, ret, start)
 
 		upstreamErr = err
 
 		if err != nil {
 			// Kick off health check to see if *our* upstream is broken.
-			if b.maxfails != 0 {
+			if g.maxfails != 0 {
 				proxy.Healthcheck()
 			}
 
@@ -156,93 +298,240 @@ func (b *Bypass) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 			break
 		}
 
-		// Check if the reply is correct; if not return FormErr.
-		if !state.Match(ret) {
-			debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, state.QName(), state.QType())
-
-			formerr := new(dns.Msg)
-			formerr.SetRcode(state.Req, dns.RcodeFormatError)
-			w.WriteMsg(formerr)
-			return 0, taperr
+		if g.bogus != nil {
+			if ip := g.bogus.set.Find(ret); ip != nil {
+				bogus++
+				lastBogus, bogusProxy = ret, proxy
+				BogusAnswerCount.WithLabelValues(g.name, g.bogus.action).Add(1)
+				log.Debugf("Bogus answer %s for %s from %s", ip, state.Name(), proxy.addr)
+				switch {
+				case g.bogus.action == bogusRetry && bogus < len(list):
+					continue
+				case g.bogusGroup != nil:
+					// The exchanges with the other group show up in dnstap on their own.
+					fret, ffrom, ftaperr, ferr := b.resolve(ctx, orig, g.bogusGroup, timeout)
+					if ferr == nil {
+						return fret, ffrom, ftaperr, nil
+					}
+					log.Debugf("Group %s failed for %s after a bogus answer: %s", g.bogusGroup.name, state.Name(), ferr)
+				}
+				return b.rewriteBogus(ctx, state, g, proxy, ret, taperr)
+			}
 		}
 
-		w.WriteMsg(ret)
-		return 0, taperr
+		return ret, g, taperr, nil
 	}
 
+	if lastBogus != nil {
+		// Every answer we got was bogus.
+		return b.rewriteBogus(ctx, state, g, bogusProxy, lastBogus, taperr)
+	}
 	if upstreamErr != nil {
-		return dns.RcodeServerFailure, upstreamErr
+		return nil, nil, nil, upstreamErr
 	}
 
-	return dns.RcodeServerFailure, ErrNoHealthy
+	return nil, nil, nil, ErrNoHealthy
+}
 
+// routing is how a query is handled according to the rules.
+type routing struct {
+	rt        *route // the first route the name matches, nil if it goes to the default group
+	source    string // the source of the matching rule, e.g. geosite:cn
+	def       string // the default group
+	clientDef bool   // def is the default of the client's block rather than the plugin's
 }
 
-func (b *Bypass) match(state request.Request) bool {
-	if !plugin.Name(b.from).Matches(state.Name()) || !b.isAllowedDomain(state.Name()) {
-		return false
+// labels returns the labels the query is counted with in RouteCount: the group it is sent to, the
+// action and the category of the rule it matched.
+func (m routing) labels() (group, action, category string) {
+	switch m.rt {
+	case nil:
+		return m.def, actionRoute.String(), "default"
+	case apexRoute:
+		return m.rt.group, actionRoute.String(), "apex"
+	}
+	if m.rt.action == actionRoute {
+		group = m.rt.group
 	}
-	return true
+	return group, m.rt.action.String(), ruleCategory(m.source)
 }
 
-func (b *Bypass) isAllowedDomain(name string) bool {
-	if dns.Name(name) == dns.Name(b.from) {
-		return true
+// rewriteBogus returns the NXDOMAIN reply for state that replaces ret, the bogus answer of proxy in
+// group g, and reports it to dnstap. taperr is the error from reporting ret.
+func (b *Bypass) rewriteBogus(ctx context.Context, state request.Request, g *Group, proxy *Proxy, ret *dns.Msg, taperr error) (*dns.Msg, *Group, error, error) {
+	nx := g.bogus.nxdomain(state.Req, ret)
+	if err := tapRewrite(ctx, proxy, g.opts, state, nx); err != nil && taperr == nil {
+		taperr = err
 	}
-	return b.include.Has(name)
+	return nx, g, taperr, nil
 }
 
-// ForceTCP returns if TCP is forced to be used even when the request comes in over UDP.
-func (b *Bypass) ForceTCP() bool { return b.opts.forceTCP }
+// match returns how the query is handled. The routes and the default group are those of the
+// client's rules when the client has any.
+func (b *Bypass) match(state request.Request, rs *ruleSet) routing {
+	return b.matchName(state.Name(), state.IP(), rs)
+}
 
-// PreferUDP returns if UDP is preferred to be used even when the request comes in over TCP.
-func (b *Bypass) PreferUDP() bool { return b.opts.preferUDP }
+// matchName is match for a query for name from the client with address ip.
+func (b *Bypass) matchName(name, ip string, rs *ruleSet) routing {
+	routes, m := b.routes, routing{def: b.def}
+	if cr := b.clientRules(ip); cr != nil {
+		routes = cr.routes
+		if cr.def != "" {
+			m.def, m.clientDef = cr.def, true
+		}
+	}
+
+	if !plugin.Name(b.from).Matches(name) || rs.exclude.Has(name) {
+		return m
+	}
+	if dns.Name(name) == dns.Name(b.from) {
+		m.rt = apexRoute
+		return m
+	}
+	for _, rt := range routes {
+		if source, ok := rs.match(rt, name); ok {
+			m.rt, m.source = rt, source
+			return m
+		}
+	}
+	return m
+}
 
-func (b *Bypass) hook(event caddy.EventName, info interface{}) error {
-	if event != caddy.InstanceStartupEvent {
-		return nil
+// allRoutes returns the plugin's routes followed by those of all client rules.
+func (b *Bypass) allRoutes() []*route {
+	routes := append([]*route{}, b.routes...)
+	for _, cr := range b.clients {
+		routes = append(routes, cr.routes...)
 	}
-	file, err := os.Open(b.geosite)
+	return routes
+}
+
+// verifiable returns true if the answer for state may be checked against the verify set, i.e. the
+// name is in our zone and not explicitly excluded.
+func (b *Bypass) verifiable(state request.Request, rs *ruleSet) bool {
+	return plugin.Name(b.from).Matches(state.Name()) && !rs.exclude.Has(state.Name())
+}
+
+// loadRules builds a new rule set from the route and exclude lists and the verify set, and
+// publishes it with the next version number.
+func (b *Bypass) loadRules() (err error) {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+	defer func() { countReload("rules", err) }()
+
+	csum, err := b.checksum()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	fileinfo, err := file.Stat()
+	rs := newRuleSet()
+	rs.checksum = csum
+	// The geosite file is decoded once and shared by every route and the exclude list.
+	geosite, err := loadGeoSiteFile(b.geosite)
 	if err != nil {
 		return err
 	}
-	csum, err := PartialChecksum(file, fileinfo.Size())
+	for _, rt := range b.allRoutes() {
+		rs.lists[rt], err = loadGeoSiteData(geosite, rt.rules)
+		if err != nil {
+			return err
+		}
+	}
+	rs.exclude, err = loadGeoSiteData(geosite, b.excludes)
 	if err != nil {
 		return err
 	}
-	log.Infof("Running domainList  sum = %x\n", string(csum))
+	if len(b.verify) > 0 {
+		rs.verify, err = loadGeoIPData(b.geoip, b.verify)
+		if err != nil {
+			return err
+		}
+	}
+	rs.version = b.snapshot().version + 1
+	rs.loaded = time.Now()
+	b.publish(rs)
+	return nil
+}
+
+// ruleFiles returns the geosite file and every text list referenced by the route and exclude rules.
+func (b *Bypass) ruleFiles() []string {
+	var files []string
+	if b.geosite != "" {
+		files = append(files, b.geosite)
+	}
+	if b.geoip != "" && len(b.verify) > 0 {
+		files = append(files, b.geoip)
+	}
+	rules := [][]string{b.excludes}
+	for _, rt := range b.allRoutes() {
+		rules = append(rules, rt.rules)
+	}
+	for _, list := range rules {
+		for _, rule := range list {
+			if path, ok := ruleFile(rule); ok {
+				files = append(files, path)
+			}
+		}
+	}
+	return files
+}
+
+// checksum returns the combined checksum of all rule files.
+func (b *Bypass) checksum() (string, error) {
+	var sum []byte
+	for _, path := range b.ruleFiles() {
+		csum, err := FileChecksum(path)
+		if err != nil {
+			return "", err
+		}
+		sum = append(sum, csum...)
+	}
+	return string(sum), nil
+}
+
+// ForceTCP returns if TCP is forced to be used even when the request comes in over UDP.
+func (b *Bypass) ForceTCP() bool { return b.cfg.opts.forceTCP }
+
+// PreferUDP returns if UDP is preferred to be used even when the request comes in over TCP.
+func (b *Bypass) PreferUDP() bool { return b.cfg.opts.preferUDP }
+
+// watch reloads the rules and upstreams when their files change, until OnShutdown closes quit.
+func (b *Bypass) watch() {
+	rs := b.snapshot()
+	log.Infof("Running rules version %d, sum = %x", rs.version, rs.checksum)
+
+	// Notifications reload the rules soon after a change, the ticker remains as a fallback for file
+	// systems that don't deliver them.
+	files := b.ruleFiles()
+	if b.upstreamFile != "" {
+		files = append(files, b.upstreamFile)
+	}
+	var changes <-chan struct{}
+	w, err := newWatcher(files)
+	if err != nil {
+		log.Warningf("Not watching rule files, polling every %s: %s", b.dur, err)
+	} else {
+		changes = w.changes()
+	}
 	go func() {
+		if w != nil {
+			defer w.close()
+		}
 		tick := time.NewTicker(b.dur)
+		defer tick.Stop()
+		var debounce <-chan time.Time
 		for {
 			select {
+			case <-changes:
+				// Wait for the writes to settle, e.g. a file truncated and then rewritten.
+				debounce = time.After(b.debounce)
+			case <-debounce:
+				debounce = nil
+				b.reload()
+				b.reloadUpstreams()
 			case <-tick.C:
-				file, err := os.Open(b.geosite)
-				if err != nil {
-					continue
-				}
-				defer file.Close()
-				fileinfo, err := file.Stat()
-				if err != nil {
-					continue
-				}
-				_, err = PartialChecksum(file, fileinfo.Size())
-				if err != nil {
-					continue
-				}
-				if string(csum) != b.domainChecksum {
-					include, err := loadGeoSiteData(b.geosite, b.domains)
-					if err != nil {
-						continue
-					}
-					b.include = include
-					b.domainChecksum = string(csum)
-					log.Infof("Finish update domainlist size: %d", include.Len())
-				}
+				b.reload()
+				b.reloadUpstreams()
 			case <-b.quit:
 				return
 
@@ -250,9 +539,21 @@ func (b *Bypass) hook(event caddy.EventName, info interface{}) error {
 
 		}
 	}()
+}
 
-	return nil
-
+// reload loads the rules again if their files changed since the active rule set was built.
+func (b *Bypass) reload() {
+	csum, err := b.checksum()
+	if err != nil {
+		log.Warningf("Failed to check rule files: %s", err)
+		return
+	}
+	if csum == b.snapshot().checksum {
+		return
+	}
+	if err := b.loadRules(); err != nil {
+		log.Warningf("Failed to reload rules, keeping version %d: %s", b.snapshot().version, err)
+	}
 }
 
 var (
@@ -262,6 +563,8 @@ var (
 	ErrNoForward = errors.New("no forwarder defined")
 	// ErrCachedClosed means cached connection was closed by peer.
 	ErrCachedClosed = errors.New("cached connection was closed by peer")
+
+	errRaceTimeout = errors.New("group did not answer in time")
 )
 
 // options holds various options that can be set.
@@ -269,13 +572,15 @@ type options struct {
 	forceTCP           bool
 	preferUDP          bool
 	hcRecursionDesired bool
+	poison             *antiPoison // guards queries over plain UDP if set
 }
 
 const defaultTimeout = 5 * time.Second
 const defaultDuraiton = 86400 * time.Second
+const defaultDebounce = 2 * time.Second
 
 // ListPass returns a set of proxies to be used for this client depending on the policy in f.
-func (b *Bypass) ListPass() []*Proxy { return b.p.List(b.pass) }
+func (b *Bypass) ListPass() []*Proxy { return b.upstream().groups[passGroup].list() }
 
-// ListForward returns a set of proxies to be used for this client depending on the policy in f.
-func (b *Bypass) ListForward() []*Proxy { return b.p.List(b.forward) }
+// ListForward returns a set of proxies of the default group, forward unless configured otherwise.
+func (b *Bypass) ListForward() []*Proxy { return b.upstream().groups[b.def].list() }
@@ -0,0 +1,91 @@
+package bypass
+
+import (
+	"net"
+
+	"github.com/caddyserver/caddy/caddyfile"
+)
+
+// clientRules replaces the plugin's routes and default group for queries from nets.
+type clientRules struct {
+	nets   []*net.IPNet
+	routes []*route
+	def    string
+}
+
+// contains returns true if ip is in one of the networks.
+func (cr *clientRules) contains(ip net.IP) bool {
+	for _, n := range cr.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientRules returns the rules for the client that sent the query, or nil if there are none.
+func (b *Bypass) clientRules(addr string) *clientRules {
+	if len(b.clients) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	for _, cr := range b.clients {
+		if cr.contains(ip) {
+			return cr
+		}
+	}
+	return nil
+}
+
+// parseClient parses a client block:
+//
+//	client CIDR... {
+//	    include RULES
+//	    route RULES GROUP
+//	    block RULES [ACTION]
+//	    default GROUP
+//	}
+//
+// Without a default of its own the client block uses the plugin's default group, along with verify
+// and race. With one its queries only go to the groups its routes and default name.
+func parseClient(c *caddyfile.Dispenser, b *Bypass) error {
+	cr := &clientRules{}
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	for _, arg := range args {
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return err
+		}
+		cr.nets = append(cr.nets, n)
+	}
+	if !c.NextArg() || c.Val() != "{" {
+		return c.SyntaxErr("{")
+	}
+	for c.Next() {
+		switch c.Val() {
+		case "}":
+			b.clients = append(b.clients, cr)
+			return nil
+		case "include", "route", "block":
+			rt, err := parseRoute(c)
+			if err != nil {
+				return err
+			}
+			cr.routes = append(cr.routes, rt)
+		case "default":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			cr.def = c.Val()
+		default:
+			return c.Errf("unknown client property '%s'", c.Val())
+		}
+	}
+	return c.EOFErr()
+}
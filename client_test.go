@@ -0,0 +1,90 @@
+package bypass
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// countingServer is udpServer that also counts the queries it answers.
+func countingServer(t *testing.T, ip string) (string, *int32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := new(int32)
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(n, 1)
+		w.WriteMsg(reply(r, ip))
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String(), n
+}
+
+func TestClientRules(t *testing.T) {
+	// The pass answer is domestic according to the verify set, so without client rules it is kept.
+	pass, passQueries := countingServer(t, "192.0.2.1")
+	fwd := udpServer(t, "198.51.100.1")
+
+	cfg, err := parseUpstreams("pass " + pass + "\nforward " + fwd + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New()
+	up := cfg.build(nil)
+	b.up.Store(up)
+	for _, p := range up.proxies {
+		p.start(hcInterval)
+		defer p.close()
+	}
+
+	_, v4, _ := net.ParseCIDR("10.20.0.0/16")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	cn := &route{rules: []string{"domain:example.cn"}, group: passGroup}
+	b.clients = []*clientRules{
+		{nets: []*net.IPNet{v4}, def: forwardGroup},
+		{nets: []*net.IPNet{v6}, routes: []*route{cn}, def: passGroup},
+	}
+	rs := newRuleSet()
+	rs.lists[cn] = NewDomainList()
+	rs.lists[cn].Add("example.cn")
+	if rs.verify, err = parseIPList([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	b.publish(rs)
+
+	tests := []struct {
+		client, name, want string
+		passQueries        int32
+	}{
+		{"10.99.0.1", "example.org.", "192.0.2.1", 1},    // plugin default, verified pass answer
+		{"10.20.1.1", "example.org.", "198.51.100.1", 0}, // client default forward, pass not asked
+		{"2001:db8::1", "example.cn.", "192.0.2.1", 1},   // client route
+		{"2001:db8::1", "example.org.", "192.0.2.1", 1},  // client default pass, asked once
+		{"2001:db9::1", "example.cn.", "192.0.2.1", 1},   // outside the prefix, plugin rules
+	}
+	for _, race := range []bool{false, true} {
+		b.race = race
+		for _, tc := range tests {
+			atomic.StoreInt32(passQueries, 0)
+			m := new(dns.Msg)
+			m.SetQuestion(tc.name, dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.client})
+			if _, err := b.ServeDNS(context.Background(), rec, m); err != nil {
+				t.Fatalf("race %v, %s from %s: %s", race, tc.name, tc.client, err)
+			}
+			if got := rec.Msg.Answer[0].(*dns.A).A.String(); got != tc.want {
+				t.Errorf("race %v, %s from %s: got %s, want %s", race, tc.name, tc.client, got, tc.want)
+			}
+			if n := atomic.LoadInt32(passQueries); n != tc.passQueries {
+				t.Errorf("race %v, %s from %s: pass asked %d times, want %d", race, tc.name, tc.client, n, tc.passQueries)
+			}
+		}
+	}
+}
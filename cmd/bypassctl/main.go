@@ -0,0 +1,284 @@
+// Command bypassctl inspects geosite files and tests names against bypass rules.
+//
+//	bypassctl list [-geosite FILE]
+//	bypassctl dump [-geosite FILE] [-attrs] RULE...
+//	bypassctl test [-geosite FILE] -include RULES [-exclude RULES] [NAME...]
+//	bypassctl diff [-category NAMES] OLD NEW
+//	bypassctl build -o FILE DIR...
+//
+// list prints the categories of a geosite file with their number of domains. dump prints the
+// domains a rule such as geosite:cn@!ads stands for, one per line in the format of a text list, or
+// with their attributes in the format build reads.
+// test reports the include or exclude rule each name matches, names are read from standard input
+// when none are given. diff prints the domains added (+) and removed (-) per category between two
+// geosite files. build compiles directories of category text files in domain-list-community syntax
+// into a geosite file.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lostz/bypass"
+	"github.com/miekg/dns"
+	"v2ray.com/core/app/router"
+)
+
+const defaultGeoSite = "geosite.dat"
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "list":
+		err = list(args)
+	case "dump":
+		err = dump(args)
+	case "test":
+		err = test(args)
+	case "diff":
+		err = diff(args)
+	case "build":
+		err = build(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bypassctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+	bypassctl list [-geosite FILE]
+	bypassctl dump [-geosite FILE] [-attrs] RULE...
+	bypassctl test [-geosite FILE] -include RULES [-exclude RULES] [NAME...]
+	bypassctl diff [-category NAMES] OLD NEW
+	bypassctl build -o FILE DIR...`)
+	os.Exit(2)
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	path := fs.String("geosite", defaultGeoSite, "geosite `file`")
+	fs.Parse(args)
+
+	geosite, err := bypass.LoadGeoSite(*path)
+	if err != nil {
+		return err
+	}
+	entries := geosite.GetEntry()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].GetCountryCode() < entries[j].GetCountryCode() })
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%d\n", strings.ToLower(entry.GetCountryCode()), len(entry.GetDomain()))
+	}
+	return nil
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	path := fs.String("geosite", defaultGeoSite, "geosite `file`")
+	attrs := fs.Bool("attrs", false, "print the attributes of the domains")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage()
+	}
+
+	geosite, err := bypass.LoadGeoSite(*path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, rule := range fs.Args() {
+		domains, err := bypass.DomainRules(geosite, rule)
+		if err != nil {
+			return err
+		}
+		for _, d := range domains {
+			if *attrs {
+				fmt.Fprintln(w, formatWithAttributes(d))
+				continue
+			}
+			fmt.Fprintln(w, bypass.FormatRule(d))
+		}
+	}
+	return nil
+}
+
+func test(args []string) error {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	path := fs.String("geosite", defaultGeoSite, "geosite `file`")
+	include := fs.String("include", "", "comma separated include `rules`")
+	exclude := fs.String("exclude", "", "comma separated exclude `rules`")
+	fs.Parse(args)
+	if *include == "" {
+		usage()
+	}
+
+	in, err := bypass.LoadDomainList(*path, strings.Split(*include, ","))
+	if err != nil {
+		return err
+	}
+	ex := bypass.NewDomainList()
+	if *exclude != "" {
+		if ex, err = bypass.LoadDomainList(*path, strings.Split(*exclude, ",")); err != nil {
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	check := func(name string) {
+		name = dns.Fqdn(strings.ToLower(name))
+		// Exclude rules win, as in the plugin.
+		if rule, source, ok := ex.Match(name); ok {
+			fmt.Fprintf(w, "%s\texclude\t%s\t%s\n", name, rule, source)
+			return
+		}
+		if rule, source, ok := in.Match(name); ok {
+			fmt.Fprintf(w, "%s\tinclude\t%s\t%s\n", name, rule, source)
+			return
+		}
+		fmt.Fprintf(w, "%s\tnone\n", name)
+	}
+	if fs.NArg() > 0 {
+		for _, name := range fs.Args() {
+			check(name)
+		}
+		return nil
+	}
+	return eachLine(os.Stdin, check)
+}
+
+// eachLine calls f for every non-empty line of r that isn't a comment.
+func eachLine(r io.Reader, f func(string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f(line)
+	}
+	return scanner.Err()
+}
+
+func diff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	only := fs.String("category", "", "comma separated `names` of the categories to compare, all by default")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	old, err := categories(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cur, err := categories(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	if *only != "" {
+		names = strings.Split(strings.ToLower(*only), ",")
+	} else {
+		seen := make(map[string]bool)
+		for _, m := range []map[string]map[string]bool{old, cur} {
+			for name := range m {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+		sort.Strings(names)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, name := range names {
+		added, removed := difference(cur[name], old[name]), difference(old[name], cur[name])
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t+%d\t-%d\n", name, len(added), len(removed))
+		for _, rule := range removed {
+			fmt.Fprintf(w, "-%s\n", rule)
+		}
+		for _, rule := range added {
+			fmt.Fprintf(w, "+%s\n", rule)
+		}
+	}
+	return nil
+}
+
+// categories returns the rules of every category in the geosite file at path, by lower case name.
+func categories(path string) (map[string]map[string]bool, error) {
+	geosite, err := bypass.LoadGeoSite(path)
+	if err != nil {
+		return nil, err
+	}
+	cats := make(map[string]map[string]bool, len(geosite.GetEntry()))
+	for _, entry := range geosite.GetEntry() {
+		rules := make(map[string]bool, len(entry.GetDomain()))
+		for _, d := range entry.GetDomain() {
+			rules[formatWithAttributes(d)] = true
+		}
+		cats[strings.ToLower(entry.GetCountryCode())] = rules
+	}
+	return cats, nil
+}
+
+// formatWithAttributes formats d as a text rule followed by its attributes.
+func formatWithAttributes(d *router.Domain) string {
+	s := bypass.FormatRule(d)
+	for _, attr := range d.GetAttribute() {
+		s += " @" + attr.GetKey()
+	}
+	return s
+}
+
+// difference returns the sorted rules in a that aren't in b.
+func difference(a, b map[string]bool) []string {
+	var rules []string
+	for rule := range a {
+		if !b[rule] {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+func build(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	// No default, so a build can't overwrite the geosite file in use by accident.
+	out := fs.String("o", "", "output `file`, required")
+	fs.Parse(args)
+	if *out == "" || fs.NArg() == 0 {
+		usage()
+	}
+
+	list, err := bypass.CompileGeoSite(fs.Args()...)
+	if err != nil {
+		return err
+	}
+	if err := bypass.WriteGeoSite(*out, list); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d categories to %s\n", len(list.GetEntry()), *out)
+	return nil
+}
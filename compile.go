@@ -0,0 +1,233 @@
+package bypass
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"v2ray.com/core/app/router"
+)
+
+// CompileGeoSite compiles directories of category files in domain-list-community syntax into a
+// geosite list. The name of a file is the name of its category, files with the same name in several
+// directories are merged. Every line holds one rule followed by optional attributes:
+//
+//	example.com @cn
+//	full:www.example.com
+//	keyword:example
+//	regexp:^ex\d+\.example\.com$
+//	include:other @cn @-ads
+//
+// An include adds the rules of another category, optionally only those with (@attr) or without
+// (@-attr) an attribute. Text after a # is a comment. The categories and their rules are sorted so
+// the same input always compiles to the same output.
+func CompileGeoSite(dirs ...string) (*router.GeoSiteList, error) {
+	files := make(map[string]*categoryFile)
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			name := strings.ToLower(info.Name())
+			cf, ok := files[name]
+			if !ok {
+				cf = &categoryFile{}
+				files[name] = cf
+			}
+			if err := cf.parse(filepath.Join(dir, info.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	c := &compiler{files: files, done: make(map[string][]*router.Domain), busy: make(map[string]bool)}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := new(router.GeoSiteList)
+	for _, name := range names {
+		domains, err := c.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		list.Entry = append(list.Entry, &router.GeoSite{CountryCode: strings.ToUpper(name), Domain: domains})
+	}
+	return list, nil
+}
+
+// WriteGeoSite writes list to the file at path.
+func WriteGeoSite(path string, list *router.GeoSiteList) error {
+	data, err := proto.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// categoryFile holds the rules and includes of a category, before the includes are resolved.
+type categoryFile struct {
+	domains  []*router.Domain
+	includes []include
+}
+
+// include refers to the rules of another category that match attrs.
+type include struct {
+	name  string
+	attrs attributeMatchers
+}
+
+func (cf *categoryFile) parse(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := cf.parseLine(fields); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (cf *categoryFile) parseLine(fields []string) error {
+	rule, attrs := fields[0], fields[1:]
+	for _, attr := range attrs {
+		if !strings.HasPrefix(attr, "@") || len(attr) == 1 {
+			return fmt.Errorf("invalid attribute %q", attr)
+		}
+	}
+
+	if strings.HasPrefix(rule, "include:") {
+		inc := include{name: strings.ToLower(rule[len("include:"):])}
+		if inc.name == "" {
+			return fmt.Errorf("empty include")
+		}
+		for _, attr := range attrs {
+			m := attributeMatcher{key: strings.ToLower(attr[1:])}
+			if strings.HasPrefix(m.key, "-") || strings.HasPrefix(m.key, "!") {
+				m.key, m.negate = m.key[1:], true
+			}
+			inc.attrs = append(inc.attrs, m)
+		}
+		cf.includes = append(cf.includes, inc)
+		return nil
+	}
+
+	d, err := parseTextRule(rule)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		d.Attribute = append(d.Attribute, &router.Domain_Attribute{
+			Key:        strings.ToLower(attr[1:]),
+			TypedValue: &router.Domain_Attribute_BoolValue{BoolValue: true},
+		})
+	}
+	cf.domains = append(cf.domains, d)
+	return nil
+}
+
+// compiler resolves the includes of category files.
+type compiler struct {
+	files map[string]*categoryFile
+	done  map[string][]*router.Domain // resolved categories
+	busy  map[string]bool             // categories being resolved, to detect include loops
+}
+
+// resolve returns the sorted rules of the category name, including those of the categories it
+// includes.
+func (c *compiler) resolve(name string) ([]*router.Domain, error) {
+	if domains, ok := c.done[name]; ok {
+		return domains, nil
+	}
+	cf, ok := c.files[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown category %q", name)
+	}
+	if c.busy[name] {
+		return nil, fmt.Errorf("include loop in category %q", name)
+	}
+	c.busy[name] = true
+	defer delete(c.busy, name)
+
+	domains := append([]*router.Domain(nil), cf.domains...)
+	for _, inc := range cf.includes {
+		included, err := c.resolve(inc.name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		for _, d := range included {
+			if inc.attrs.Match(d) {
+				domains = append(domains, d)
+			}
+		}
+	}
+	domains = sortDomains(domains)
+	c.done[name] = domains
+	return domains, nil
+}
+
+// sortDomains sorts domains by type and value and removes duplicates. The attributes of duplicates
+// are merged.
+func sortDomains(domains []*router.Domain) []*router.Domain {
+	byRule := make(map[string]*router.Domain, len(domains))
+	for _, d := range domains {
+		rule := FormatRule(d)
+		seen, ok := byRule[rule]
+		if !ok {
+			// Copy, the rule may be merged with others and is shared with the categories including it.
+			byRule[rule] = &router.Domain{Type: d.GetType(), Value: d.GetValue(), Attribute: append([]*router.Domain_Attribute(nil), d.GetAttribute()...)}
+			continue
+		}
+		for _, attr := range d.GetAttribute() {
+			if !hasAttribute(seen, attr.GetKey()) {
+				seen.Attribute = append(seen.Attribute, attr)
+			}
+		}
+	}
+
+	sorted := make([]*router.Domain, 0, len(byRule))
+	for _, d := range byRule {
+		sort.Slice(d.Attribute, func(i, j int) bool { return d.Attribute[i].GetKey() < d.Attribute[j].GetKey() })
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].GetType() != sorted[j].GetType() {
+			return sorted[i].GetType() < sorted[j].GetType()
+		}
+		return sorted[i].GetValue() < sorted[j].GetValue()
+	})
+	return sorted
+}
+
+func hasAttribute(d *router.Domain, key string) bool {
+	for _, attr := range d.GetAttribute() {
+		if attr.GetKey() == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package bypass
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestCompileGeoSite(t *testing.T) {
+	dir1, err := ioutil.TempDir("", "geosite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir1)
+	dir2, err := ioutil.TempDir("", "geosite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir2)
+
+	files := map[string]string{
+		filepath.Join(dir1, "example"): "# Example\nexample.com @cn\nfull:www.example.org\nexample.com @ads # again\ninclude:ads @-cn\n",
+		filepath.Join(dir1, "ads"):     "keyword:doubleclick\nregexp:^ad\\d+\\.\nads.cn @cn\n",
+		filepath.Join(dir2, "example"): "domain:example.net\n",
+	}
+	for path, content := range files {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := CompileGeoSite(dir1, dir2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(list.GetEntry()); n != 2 || list.GetEntry()[0].GetCountryCode() != "ADS" {
+		t.Fatalf("got %d categories, first %q", n, list.GetEntry()[0].GetCountryCode())
+	}
+
+	var got []string
+	for _, d := range list.GetEntry()[1].GetDomain() {
+		rule := FormatRule(d)
+		for _, attr := range d.GetAttribute() {
+			rule += " @" + attr.GetKey()
+		}
+		got = append(got, rule)
+	}
+	want := []string{"keyword:doubleclick", `regexp:^ad\d+\.`, "domain:example.com @ads @cn", "domain:example.net", "full:www.example.org"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	// The same input compiles to the same bytes.
+	first, _ := proto.Marshal(list)
+	again, err := CompileGeoSite(dir1, dir2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := proto.Marshal(again)
+	if !bytes.Equal(first, second) {
+		t.Error("output is not deterministic")
+	}
+
+	// And it loads like any other geosite file.
+	out := filepath.Join(dir1, ".geosite.dat")
+	if err := WriteGeoSite(out, list); err != nil {
+		t.Fatal(err)
+	}
+	l, err := LoadDomainList(out, []string{"geosite:example@cn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Has("www.example.com.") || l.Has("www.example.net.") {
+		t.Error("geosite:example@cn doesn't match as compiled")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir2, "ads"), []byte("include:example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompileGeoSite(dir1, dir2); err == nil {
+		t.Error("expected error for include loop")
+	}
+}
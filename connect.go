@@ -2,7 +2,9 @@ package bypass
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
+	"net"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -41,9 +43,11 @@ func (t *Transport) updateDialTimeout(newDialTime time.Duration) {
 
 // Dial dials the address configured in transport, potentially reusing a connection or creating a new one.
 func (t *Transport) Dial(proto string) (*dns.Conn, bool, error) {
-	// If tls has been configured; use it.
+	// If tls has been configured; use it. A proxy only carries TCP.
 	if t.tlsConfig != nil {
 		proto = "tcp-tls"
+	} else if t.via != nil {
+		proto = "tcp"
 	}
 
 	t.dial <- proto
@@ -55,6 +59,11 @@ func (t *Transport) Dial(proto string) (*dns.Conn, bool, error) {
 
 	reqTime := time.Now()
 	timeout := t.dialTimeout()
+	if t.via != nil {
+		conn, err := t.dialVia(proto, timeout)
+		t.updateDialTimeout(time.Since(reqTime))
+		return conn, false, err
+	}
 	if proto == "tcp-tls" {
 		conn, err := dns.DialTimeoutWithTLS("tcp", t.addr, t.tlsConfig, timeout)
 		t.updateDialTimeout(time.Since(reqTime))
@@ -65,10 +74,38 @@ func (t *Transport) Dial(proto string) (*dns.Conn, bool, error) {
 	return conn, false, err
 }
 
+// dialVia dials the address configured in transport through its proxy, proto is tcp or tcp-tls.
+func (t *Transport) dialVia(proto string, timeout time.Duration) (*dns.Conn, error) {
+	conn, err := t.via.dial(t.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if proto == "tcp-tls" {
+		tc := tls.Client(conn, t.tlsConfig)
+		tc.SetDeadline(time.Now().Add(timeout))
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
 // Connect selects an upstream, sends the request and waits for a response.
 func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options) (*dns.Msg, error) {
 	start := time.Now()
 
+	if p.doh != nil {
+		ret, err := p.doh.exchange(ctx, state.Req)
+		if err != nil {
+			return nil, err
+		}
+		p.observe(ret, start)
+		return ret, nil
+	}
+
 	proto := ""
 	switch {
 	case opts.forceTCP: // TCP flag has precedence over UDP flag
@@ -90,8 +127,18 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options
 		conn.UDPSize = 512
 	}
 
+	// Only plain UDP can be spoofed from the path.
+	poison := opts.poison
+	if _, udp := conn.Conn.(*net.UDPConn); !udp {
+		poison = nil
+	}
+	sent := state.Req
+	if poison != nil {
+		sent = poison.prepare(state.Req)
+	}
+
 	conn.SetWriteDeadline(time.Now().Add(maxTimeout))
-	if err := conn.WriteMsg(state.Req); err != nil {
+	if err := conn.WriteMsg(sent); err != nil {
 		conn.Close() // not giving it back
 		if err == io.EOF && cached {
 			return nil, ErrCachedClosed
@@ -101,6 +148,17 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options
 
 	var ret *dns.Msg
 	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	if poison != nil {
+		ret, err = p.readGuarded(conn, sent, poison)
+		if err != nil {
+			conn.Close() // not giving it back
+			return nil, err
+		}
+		restoreCase(state.Req, sent, ret)
+		p.transport.Yield(conn)
+		p.observe(ret, start)
+		return ret, nil
+	}
 	for {
 		ret, err = conn.ReadMsg()
 		if err != nil {
@@ -118,6 +176,12 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options
 
 	p.transport.Yield(conn)
 
+	p.observe(ret, start)
+	return ret, nil
+}
+
+// observe updates the metrics for a reply received from p.
+func (p *Proxy) observe(ret *dns.Msg, start time.Time) {
 	rc, ok := dns.RcodeToString[ret.Rcode]
 	if !ok {
 		rc = strconv.Itoa(ret.Rcode)
@@ -126,8 +190,6 @@ func (p *Proxy) Connect(ctx context.Context, state request.Request, opts options
 	RequestCount.WithLabelValues(p.addr).Add(1)
 	RcodeCount.WithLabelValues(rc, p.addr).Add(1)
 	RequestDuration.WithLabelValues(p.addr).Observe(time.Since(start).Seconds())
-
-	return ret, nil
 }
 
 const cumulativeAvgWeight = 4
@@ -0,0 +1,217 @@
+package bypass
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialProxy dials TCP connections through a SOCKS5 (RFC 1928) or an HTTP CONNECT proxy, given as
+// socks5://[USER:PASSWORD@]HOST:PORT or http://[USER:PASSWORD@]HOST:PORT. A proxy can't carry UDP,
+// so the upstreams of a group that uses one are always queried over TCP.
+type dialProxy struct {
+	url *url.URL
+}
+
+func parseDialProxy(s string) (*dialProxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q, want socks5 or http", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy %q needs a host and a port", u.Redacted())
+	}
+	if u.User != nil && u.Scheme == "socks5" {
+		pass, _ := u.User.Password()
+		if len(u.User.Username()) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("proxy %q: user name and password are limited to 255 bytes", u.Redacted())
+		}
+	}
+	return &dialProxy{url: u}, nil
+}
+
+// String returns the proxy URL without its password.
+func (d *dialProxy) String() string { return d.url.Redacted() }
+
+// dial connects to addr, a host:port, through the proxy.
+func (d *dialProxy) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.url.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if d.url.Scheme == "socks5" {
+		err = d.socks5(conn, addr)
+	} else {
+		err = d.connect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", d, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5 asks the SOCKS5 server on conn to connect to addr.
+func (d *dialProxy) socks5(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{socksNoAuth}
+	if d.url.User != nil {
+		methods = append(methods, socksUserPass)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 server, version %d", buf[0])
+	}
+	switch buf[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if d.url.User == nil {
+			return errors.New("server requires authentication")
+		}
+		// RFC 1929
+		user := d.url.User.Username()
+		pass, _ := d.url.User.Password()
+		req := []byte{1, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socksErrors) {
+			return fmt.Errorf("connect to %s: %s", addr, socksErrors[reply[1]])
+		}
+		return fmt.Errorf("connect to %s: error %d", addr, reply[1])
+	}
+	// Skip the bound address and port.
+	var n int
+	switch reply[3] {
+	case socksIPv4:
+		n = net.IPv4len
+	case socksIPv6:
+		n = net.IPv6len
+	case socksDomain:
+		if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+			return err
+		}
+		n = int(reply[0])
+	default:
+		return fmt.Errorf("unknown address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// connect asks the HTTP proxy on conn to connect to addr.
+func (d *dialProxy) connect(conn net.Conn, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.url.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("connect to %s: %s", addr, resp.Status)
+	}
+	// The upstream doesn't speak first, anything buffered would be lost.
+	if br.Buffered() > 0 {
+		return errors.New("unexpected data after CONNECT reply")
+	}
+	return nil
+}
+
+const (
+	socksVersion  = 5
+	socksNoAuth   = 0
+	socksUserPass = 2
+	socksConnect  = 1
+	socksIPv4     = 1
+	socksDomain   = 3
+	socksIPv6     = 4
+)
+
+var socksErrors = []string{
+	"succeeded",
+	"general failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
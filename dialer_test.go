@@ -0,0 +1,171 @@
+package bypass
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// tcpDNSServer starts a DNS server on TCP only, that answers every query with an empty reply.
+func tcpDNSServer(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})}
+	go s.ActivateAndServe()
+	return l.Addr().String(), func() { s.Shutdown() }
+}
+
+// proxyServer runs a minimal SOCKS5 or HTTP CONNECT proxy that requires user:secret and records
+// the addresses it was asked to connect to.
+func proxyServer(t *testing.T, socks bool) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	targets := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var target string
+				if socks {
+					target = socksHandshake(conn)
+				} else {
+					target = connectHandshake(conn)
+				}
+				if target == "" {
+					return
+				}
+				targets <- target
+				up, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer up.Close()
+				go io.Copy(up, conn)
+				io.Copy(conn, up)
+			}()
+		}
+	}()
+	return l.Addr().String(), targets
+}
+
+func socksHandshake(conn net.Conn) string {
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return ""
+	}
+	io.ReadFull(conn, buf[:buf[1]])
+	conn.Write([]byte{5, socksUserPass})
+	// user:secret
+	io.ReadFull(conn, buf[:2])
+	n := buf[1]
+	io.ReadFull(conn, buf[:n])
+	user := string(buf[:n])
+	io.ReadFull(conn, buf[:1])
+	n = buf[0]
+	io.ReadFull(conn, buf[:n])
+	if user != "user" || string(buf[:n]) != "secret" {
+		conn.Write([]byte{1, 1})
+		return ""
+	}
+	conn.Write([]byte{1, 0})
+
+	io.ReadFull(conn, buf[:4])
+	if buf[3] != socksIPv4 {
+		conn.Write([]byte{5, 8, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+		return ""
+	}
+	io.ReadFull(conn, buf[:6])
+	target := net.JoinHostPort(net.IP(buf[:4]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(buf[4:6]))))
+	conn.Write([]byte{5, 0, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return target
+}
+
+func connectHandshake(conn net.Conn) string {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return ""
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return ""
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return req.Host
+}
+
+func TestDialProxy(t *testing.T) {
+	addr, stop := tcpDNSServer(t)
+	defer stop()
+
+	for _, socks := range []bool{true, false} {
+		paddr, targets := proxyServer(t, socks)
+		scheme := "http"
+		if socks {
+			scheme = "socks5"
+		}
+
+		via, err := parseDialProxy(scheme + "://user:secret@" + paddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewProxy(addr, transport.DNS)
+		p.SetDialProxy(via)
+		p.start(hcInterval)
+
+		// A UDP query is sent over TCP and the connection is pooled.
+		for i := 0; i < 2; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			state := request.Request{W: &test.ResponseWriter{}, Req: m}
+			if _, err := p.Connect(context.Background(), state, options{}); err != nil {
+				t.Fatalf("%s: %s", scheme, err)
+			}
+		}
+		if got := <-targets; got != addr {
+			t.Errorf("%s: proxy connected to %s, want %s", scheme, got, addr)
+		}
+		if len(targets) != 0 {
+			t.Errorf("%s: connection wasn't reused", scheme)
+		}
+
+		if err := p.health.Check(p); err != nil {
+			t.Errorf("%s: health check failed: %s", scheme, err)
+		}
+
+		bad, _ := parseDialProxy(scheme + "://user:wrong@" + paddr)
+		if _, err := bad.dial(addr, hcTimeout); err == nil {
+			t.Errorf("%s: expected authentication error", scheme)
+		}
+		p.close()
+	}
+
+	for _, s := range []string{"socks4://127.0.0.1:1080", "socks5://127.0.0.1", "http://:8080"} {
+		if _, err := parseDialProxy(s); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
@@ -12,30 +12,13 @@ import (
 	"github.com/miekg/dns"
 )
 
-func toDnstap(ctx context.Context, host string, b *Bypass, state request.Request, reply *dns.Msg, start time.Time) error {
+func toDnstap(ctx context.Context, p *Proxy, opts options, state request.Request, reply *dns.Msg, start time.Time) error {
 	tapper := dnstap.TapperFromContext(ctx)
 	if tapper == nil {
 		return nil
 	}
 	// Query
-	m := msg.New().Time(start).HostPort(host)
-	opts := b.opts
-	t := ""
-	switch {
-	case opts.forceTCP: // TCP flag has precedence over UDP flag
-		t = "tcp"
-	case opts.preferUDP:
-		t = "udp"
-	default:
-		t = state.Proto()
-	}
-
-	if t == "tcp" {
-		m.SocketProto = tap.SocketProtocol_TCP
-	} else {
-		m.SocketProto = tap.SocketProtocol_UDP
-	}
-
+	m := tapBuilder(p, opts, state).Time(start)
 	if tapper.Pack() {
 		m.Msg(state.Req)
 	}
@@ -59,3 +42,45 @@ func toDnstap(ctx context.Context, host string, b *Bypass, state request.Request
 
 	return nil
 }
+
+// tapRewrite sends reply, which the plugin answers with instead of the reply of p, to dnstap as
+// another forwarder response to the query, after the one toDnstap sent.
+func tapRewrite(ctx context.Context, p *Proxy, opts options, state request.Request, reply *dns.Msg) error {
+	tapper := dnstap.TapperFromContext(ctx)
+	if tapper == nil {
+		return nil
+	}
+	m := tapBuilder(p, opts, state).Time(time.Now())
+	if tapper.Pack() {
+		m.Msg(reply)
+	}
+	msg, err := m.ToOutsideResponse(tap.Message_FORWARDER_RESPONSE)
+	if err != nil {
+		return err
+	}
+	tapper.TapMessage(msg)
+	return nil
+}
+
+// tapBuilder returns a dnstap message builder for an exchange with p.
+func tapBuilder(p *Proxy, opts options, state request.Request) *msg.Builder {
+	m := msg.New().HostPort(p.addr)
+	t := ""
+	switch {
+	case p.doh != nil, p.transport.via != nil: // DNS-over-HTTPS and proxied queries are always carried over TCP
+		t = "tcp"
+	case opts.forceTCP: // TCP flag has precedence over UDP flag
+		t = "tcp"
+	case opts.preferUDP:
+		t = "udp"
+	default:
+		t = state.Proto()
+	}
+
+	if t == "tcp" {
+		m.SocketProto = tap.SocketProtocol_TCP
+	} else {
+		m.SocketProto = tap.SocketProtocol_UDP
+	}
+	return m
+}
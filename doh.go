@@ -0,0 +1,127 @@
+package bypass
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohClient sends queries to a DNS-over-HTTPS upstream as defined in RFC 8484. It always dials
+// addr, the host in the URL is only used for the Host header and, without a configured server
+// name, for verifying the certificate. Connections are kept by the HTTP client, which speaks HTTP/2
+// when the server does.
+type dohClient struct {
+	addr      string // host:port to dial
+	path      string
+	method    string
+	tlsConfig *tls.Config
+	expire    time.Duration
+	via       *dialProxy
+
+	url    string
+	client *http.Client
+}
+
+func newDoHClient(addr, path string) *dohClient {
+	d := &dohClient{addr: addr, path: path, method: http.MethodPost, tlsConfig: new(tls.Config), expire: defaultExpire}
+	d.configure()
+	return d
+}
+
+// configure sets up the HTTP client. It must be called again after changing the TLS config or
+// the expire duration, and only before the client is used.
+func (d *dohClient) configure() {
+	host := d.addr
+	if d.tlsConfig.ServerName != "" {
+		host = d.tlsConfig.ServerName
+	}
+	d.url = "https://" + host + d.path
+
+	dialer := &net.Dialer{Timeout: maxTimeout}
+	tr := &http.Transport{
+		TLSClientConfig:   d.tlsConfig.Clone(),
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if d.via != nil {
+				return d.via.dial(d.addr, maxTimeout)
+			}
+			return dialer.DialContext(ctx, network, d.addr)
+		},
+		IdleConnTimeout:     d.expire,
+		MaxIdleConnsPerHost: 4,
+		TLSHandshakeTimeout: maxTimeout,
+	}
+	d.client = &http.Client{Transport: tr, Timeout: maxTimeout + readTimeout}
+}
+
+// exchange sends m and returns the reply.
+func (d *dohClient) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// An id of 0 makes GET requests cacheable, RFC 8484 section 4.1.
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if d.method == http.MethodGet {
+		req, err = http.NewRequest(http.MethodGet, d.url+"?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, d.url, bytes.NewReader(buf))
+		if req != nil {
+			req.Header.Set("Content-Type", dohMimeType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMimeType)
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh upstream %s returned %s", d.url, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dohMimeType) {
+		return nil, fmt.Errorf("doh upstream %s returned content type %q", d.url, ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		return nil, err
+	}
+	ret.Id = m.Id
+	return ret, nil
+}
+
+// splitDoHPath splits addr into the address to dial and the URL path, which defaults to
+// /dns-query.
+func splitDoHPath(addr string) (string, string) {
+	if i := strings.Index(addr, "/"); i >= 0 {
+		return addr[:i], addr[i:]
+	}
+	return addr, defaultDoHPath
+}
+
+const (
+	dohMimeType    = "application/dns-message"
+	defaultDoHPath = "/dns-query"
+)
@@ -0,0 +1,107 @@
+package bypass
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// dohServer answers every query with an A record and records the HTTP requests it got.
+type dohServer struct {
+	mu      sync.Mutex
+	methods []string
+	remotes map[string]bool
+}
+
+func (s *dohServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMimeType {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil || r.URL.Path != "/dns-query" || r.ProtoMajor != 2 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil || m.Id != 0 {
+		http.Error(w, "bad message", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.methods = append(s.methods, r.Method)
+	s.remotes[r.RemoteAddr] = true
+	s.mu.Unlock()
+
+	ret := new(dns.Msg)
+	ret.SetReply(m)
+	ret.Answer = append(ret.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	out, _ := ret.Pack()
+	w.Header().Set("Content-Type", dohMimeType)
+	w.Write(out)
+}
+
+func TestDoHProxy(t *testing.T) {
+	s := &dohServer{remotes: make(map[string]bool)}
+	srv := httptest.NewUnstartedServer(s)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	g := NewGroup(passGroup)
+	if err := g.add("https://" + strings.TrimPrefix(srv.URL, "https://") + "/dns-query"); err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(g.addrs[0], g.transports[0])
+	p.SetTLSConfig(srv.Client().Transport.(*http.Transport).TLSClientConfig)
+	defer p.close()
+
+	for _, method := range []string{http.MethodPost, http.MethodGet, http.MethodPost} {
+		p.SetDoHMethod(method)
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: m}
+		ret, err := p.Connect(context.Background(), state, options{})
+		if err != nil {
+			t.Fatalf("%s: %s", method, err)
+		}
+		if ret.Id != m.Id || len(ret.Answer) != 1 {
+			t.Errorf("%s: unexpected reply %v", method, ret)
+		}
+	}
+	if len(s.methods) != 3 || s.methods[1] != http.MethodGet {
+		t.Errorf("got methods %v", s.methods)
+	}
+	if len(s.remotes) != 1 {
+		t.Errorf("expected one reused connection, got %d", len(s.remotes))
+	}
+
+	if err := p.health.Check(p); err != nil {
+		t.Errorf("health check failed: %s", err)
+	}
+	srv.Close()
+	if err := p.health.Check(p); err == nil || p.fails != 1 {
+		t.Errorf("expected failed health check, got %v with %d fails", err, p.fails)
+	}
+}
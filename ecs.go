@@ -0,0 +1,222 @@
+package bypass
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+type ecsMode int
+
+const (
+	ecsPass  ecsMode = iota // leave the client's ECS option alone
+	ecsStrip                // remove any ECS option
+	ecsAdd                  // replace any ECS option with our own subnet
+)
+
+// ecsOption is the EDNS Client Subnet handling of a group. A nil *ecsOption passes ECS through.
+type ecsOption struct {
+	mode ecsMode
+
+	subnet *net.IPNet // fixed subnet to add, nil means derive it from the client address
+	v4     int        // prefix length for client derived IPv4 subnets
+	v6     int        // prefix length for client derived IPv6 subnets
+}
+
+// ecsUndo is what has to be changed back in the reply to a request apply rewrote, so the client
+// doesn't get back what it didn't send (RFC 7871, section 7.2.1).
+type ecsUndo struct {
+	kind   undoKind
+	client *dns.EDNS0_SUBNET // the client's ECS option, for undoClient
+}
+
+type undoKind int
+
+const (
+	undoNothing undoKind = iota
+	undoOPT              // the request had no OPT record, remove the reply's
+	undoECS              // the request had no ECS option, remove the reply's
+	undoClient           // the request had its own ECS option, put it back in place of the reply's
+)
+
+// restore changes back in m what u says.
+func (u ecsUndo) restore(m *dns.Msg) {
+	switch u.kind {
+	case undoOPT:
+		removeEdns0(m)
+	case undoECS:
+		if opt := m.IsEdns0(); opt != nil {
+			removeECS(opt)
+		}
+	case undoClient:
+		opt := m.IsEdns0()
+		if opt == nil {
+			return
+		}
+		// The scope of the reply's option is what the upstream used, it's the client's to cache by.
+		client := *u.client
+		client.SourceScope = 0
+		if e := firstECS(opt); e != nil {
+			client.SourceScope = e.SourceScope
+		}
+		removeECS(opt)
+		opt.Option = append(opt.Option, &client)
+	}
+}
+
+// apply returns state with a copy of the request that has the ECS option rewritten, and what has
+// to be undone in the reply.
+func (e *ecsOption) apply(state request.Request) (request.Request, ecsUndo) {
+	if e == nil || e.mode == ecsPass {
+		return state, ecsUndo{}
+	}
+
+	subnet := e.subnet
+	if e.mode == ecsAdd && subnet == nil {
+		subnet = e.clientSubnet(state.IP())
+	}
+
+	opt := state.Req.IsEdns0()
+	if opt == nil && (e.mode == ecsStrip || subnet == nil) {
+		return state, ecsUndo{}
+	}
+
+	r := state.Req.Copy()
+	undo := ecsUndo{kind: undoECS}
+	opt = r.IsEdns0()
+	if opt == nil {
+		r.SetEdns0(uint16(state.Size()), false)
+		opt = r.IsEdns0()
+		undo.kind = undoOPT
+	} else if client := firstECS(opt); client != nil {
+		removeECS(opt)
+		undo = ecsUndo{kind: undoClient, client: client}
+	}
+
+	if e.mode == ecsAdd && subnet != nil {
+		opt.Option = append(opt.Option, toECS(subnet))
+	}
+	return request.Request{W: state.W, Req: r}, undo
+}
+
+// firstECS returns the first ECS option of opt, or nil.
+func firstECS(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// removeECS removes the ECS options from opt.
+func removeECS(opt *dns.OPT) {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// clientSubnet returns the client address masked to the configured prefix length.
+func (e *ecsOption) clientSubnet(addr string) *net.IPNet {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(e.v4, 8*net.IPv4len)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(e.v6, 8*net.IPv6len)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+func toECS(n *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := n.Mask.Size()
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(ones)}
+	if ip4 := n.IP.To4(); ip4 != nil {
+		e.Family = 1
+		e.Address = ip4
+	} else {
+		e.Family = 2
+		e.Address = n.IP
+	}
+	return e
+}
+
+// removeEdns0 removes the OPT record from m.
+func removeEdns0(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// parseECS parses the arguments of an ecs property.
+func parseECS(c *caddyfile.Dispenser) (*ecsOption, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	e := &ecsOption{v4: defaultECSv4, v6: defaultECSv6}
+	switch args[0] {
+	case "pass", "strip":
+		if len(args) != 1 {
+			return nil, c.ArgErr()
+		}
+		if args[0] == "strip" {
+			e.mode = ecsStrip
+		}
+		return e, nil
+	case "add":
+		e.mode = ecsAdd
+	default:
+		return nil, c.Errf("unknown ecs mode '%s'", args[0])
+	}
+
+	if len(args) < 2 {
+		return nil, c.ArgErr()
+	}
+	if args[1] != "client" {
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		_, n, err := net.ParseCIDR(args[1])
+		if err != nil {
+			return nil, err
+		}
+		e.subnet = n
+		return e, nil
+	}
+
+	if len(args) > 4 {
+		return nil, c.ArgErr()
+	}
+	lens := []*int{&e.v4, &e.v6}
+	bits := []int{8 * net.IPv4len, 8 * net.IPv6len}
+	for i, arg := range args[2:] {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > bits[i] {
+			return nil, c.Errf("ecs prefix length out of range: %d", n)
+		}
+		*lens[i] = n
+	}
+	return e, nil
+}
+
+const (
+	defaultECSv4 = 24
+	defaultECSv6 = 56
+)
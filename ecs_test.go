@@ -0,0 +1,146 @@
+package bypass
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// ecsOf returns the ECS option of m, or nil.
+func ecsOf(m *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func TestECSApply(t *testing.T) {
+	_, fixed, _ := net.ParseCIDR("203.0.113.0/24")
+	client := &ecsOption{mode: ecsAdd, v4: 24, v6: 56}
+
+	tests := []struct {
+		name     string
+		e        *ecsOption
+		opt, ecs bool   // what the client sent
+		want     string // the ECS address sent upstream, "" for none
+		undo     undoKind
+	}{
+		{"pass", &ecsOption{mode: ecsPass}, true, true, "192.0.2.0", undoNothing},
+		{"nil", nil, false, false, "", undoNothing},
+		{"strip", &ecsOption{mode: ecsStrip}, true, true, "", undoClient},
+		{"strip without opt", &ecsOption{mode: ecsStrip}, false, false, "", undoNothing},
+		{"add without opt", client, false, false, "198.51.100.0", undoOPT},
+		{"add without ecs", &ecsOption{mode: ecsAdd, subnet: fixed}, true, false, "203.0.113.0", undoECS},
+		{"add over ecs", client, true, true, "198.51.100.0", undoClient},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		if tc.opt {
+			m.SetEdns0(4096, false)
+		}
+		if tc.ecs {
+			_, n, _ := net.ParseCIDR("192.0.2.0/24")
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, toECS(n))
+		}
+		state := request.Request{W: &test.ResponseWriter{RemoteIP: "198.51.100.77"}, Req: m}
+
+		got, undo := tc.e.apply(state)
+		if undo.kind != tc.undo {
+			t.Errorf("%s: undo %d, want %d", tc.name, undo.kind, tc.undo)
+		}
+		addr := ""
+		if e := ecsOf(got.Req); e != nil {
+			addr = e.Address.String()
+		}
+		if addr != tc.want {
+			t.Errorf("%s: sent ECS %q, want %q", tc.name, addr, tc.want)
+		}
+		if got.Req != m && (m.IsEdns0() != nil) != tc.opt {
+			t.Errorf("%s: client's request was changed", tc.name)
+		}
+
+		// The upstream echoes the request's OPT record, with a scope for the subnet it got.
+		ret := new(dns.Msg)
+		ret.SetReply(got.Req)
+		if opt := got.Req.IsEdns0(); opt != nil {
+			ret.Extra = append(ret.Extra, dns.Copy(opt))
+		}
+		if e := ecsOf(ret); e != nil {
+			e.SourceScope = 20
+		}
+		undo.restore(ret)
+		if (ret.IsEdns0() != nil) != tc.opt {
+			t.Errorf("%s: reply has OPT record %v", tc.name, ret.IsEdns0() != nil)
+		}
+		e := ecsOf(ret)
+		if e != nil && !tc.ecs {
+			t.Errorf("%s: reply has ECS the client didn't send", tc.name)
+		}
+		if tc.ecs {
+			// The client gets back its own option, with the upstream's scope if it had one.
+			scope := uint8(0)
+			if tc.want != "" {
+				scope = 20
+			}
+			if e == nil || e.Address.String() != "192.0.2.0" || e.SourceNetmask != 24 || e.SourceScope != scope {
+				t.Errorf("%s: reply has ECS %v, want the client's 192.0.2.0/24 with scope %d", tc.name, e, scope)
+			}
+		}
+	}
+}
+
+func TestParseECS(t *testing.T) {
+	tests := []struct {
+		input  string
+		mode   ecsMode
+		subnet string
+		v4, v6 int
+		err    bool
+	}{
+		{input: "ecs pass", mode: ecsPass, v4: defaultECSv4, v6: defaultECSv6},
+		{input: "ecs strip", mode: ecsStrip, v4: defaultECSv4, v6: defaultECSv6},
+		{input: "ecs add 203.0.113.0/24", mode: ecsAdd, subnet: "203.0.113.0/24", v4: defaultECSv4, v6: defaultECSv6},
+		{input: "ecs add client", mode: ecsAdd, v4: defaultECSv4, v6: defaultECSv6},
+		{input: "ecs add client 16 48", mode: ecsAdd, v4: 16, v6: 48},
+		{input: "ecs", err: true},
+		{input: "ecs strip 1.2.3.0/24", err: true},
+		{input: "ecs add", err: true},
+		{input: "ecs add 203.0.113.0", err: true},
+		{input: "ecs add client 33", err: true},
+		{input: "ecs add client 24 56 1", err: true},
+		{input: "ecs replace", err: true},
+	}
+	for _, tc := range tests {
+		c := caddyfile.NewDispenser("test", strings.NewReader(tc.input))
+		c.Next()
+		e, err := parseECS(&c)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.input, err)
+			continue
+		}
+		subnet := ""
+		if e.subnet != nil {
+			subnet = e.subnet.String()
+		}
+		if e.mode != tc.mode || subnet != tc.subnet || e.v4 != tc.v4 || e.v6 != tc.v6 {
+			t.Errorf("%q: got %+v", tc.input, e)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package bypass
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/miekg/dns"
+	"v2ray.com/core/app/router"
+)
+
+// ipRange is an inclusive range of addresses in their 16 byte form.
+type ipRange struct {
+	start [16]byte
+	end   [16]byte
+}
+
+// IPSet is a set of CIDR ranges, stored as sorted non-overlapping ranges.
+type IPSet struct {
+	ranges []ipRange
+}
+
+// NewIPSet returns a set holding the given networks.
+func NewIPSet(nets []*net.IPNet) *IPSet {
+	ranges := make([]ipRange, 0, len(nets))
+	for _, n := range nets {
+		ranges = append(ranges, toRange(n))
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start[:], ranges[j].start[:]) < 0
+	})
+
+	// Merge overlapping and adjacent ranges.
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			next := last.end
+			if !increment(&next) || bytes.Compare(r.start[:], next[:]) <= 0 {
+				if bytes.Compare(r.end[:], last.end[:]) > 0 {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return &IPSet{ranges: merged}
+}
+
+// Contains returns true if ip is in the set.
+func (s *IPSet) Contains(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	var key [16]byte
+	copy(key[:], ip16)
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return bytes.Compare(s.ranges[i].end[:], key[:]) >= 0
+	})
+	return i < len(s.ranges) && bytes.Compare(s.ranges[i].start[:], key[:]) <= 0
+}
+
+// Len returns the number of ranges in the set.
+func (s *IPSet) Len() int { return len(s.ranges) }
+
+// Domestic returns true if every A and AAAA record in the answer section of m
+// is in the set. Replies without addresses can't be judged and are accepted.
+func (s *IPSet) Domestic(m *dns.Msg) bool {
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if !s.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns the first A or AAAA address in the answer section of m that is in the set, or nil if
+// there is none.
+func (s *IPSet) Find(m *dns.Msg) net.IP {
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if s.Contains(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func toRange(n *net.IPNet) ipRange {
+	var r ipRange
+	ip := n.IP.To16()
+	mask := n.Mask
+	if len(mask) == net.IPv4len {
+		// Move the mask onto the IPv4-mapped part of the address.
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := 0; i < 16; i++ {
+		r.start[i] = ip[i] & mask[i]
+		r.end[i] = ip[i] | ^mask[i]
+	}
+	return r
+}
+
+// increment adds one to the address, it returns false on overflow.
+func increment(ip *[16]byte) bool {
+	for i := 15; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// loadGeoIPData builds an IPSet from geoip:XX entries in the geoip file at path
+// and from literal CIDRs.
+func loadGeoIPData(path string, codes []string) (*IPSet, error) {
+	var (
+		nets  []*net.IPNet
+		geoip *router.GeoIPList
+	)
+	for _, code := range codes {
+		if !strings.HasPrefix(code, "geoip:") {
+			_, n, err := net.ParseCIDR(code)
+			if err != nil {
+				return nil, fmt.Errorf("not a geoip rule or CIDR: %q", code)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		if geoip == nil {
+			if path == "" {
+				return nil, fmt.Errorf("no geoip data loaded for %q", code)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			geoip = new(router.GeoIPList)
+			if err := proto.Unmarshal(data, geoip); err != nil {
+				return nil, err
+			}
+		}
+		country := strings.ToUpper(code[6:])
+		found := false
+		for _, entry := range geoip.GetEntry() {
+			if entry.GetCountryCode() != country {
+				continue
+			}
+			found = true
+			for _, cidr := range entry.GetCidr() {
+				ip := net.IP(cidr.GetIp())
+				if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+					continue
+				}
+				bits := 8 * len(ip)
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(int(cidr.GetPrefix()), bits)})
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown geoip code %q", code)
+		}
+	}
+	return NewIPSet(nets), nil
+}
@@ -0,0 +1,56 @@
+package bypass
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIPSet(t *testing.T) {
+	var nets []*net.IPNet
+	for _, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/24", "192.168.1.0/24", "2001:db8::/32"} {
+		_, n, _ := net.ParseCIDR(s)
+		nets = append(nets, n)
+	}
+	set := NewIPSet(nets)
+	if set.Len() != 3 {
+		t.Errorf("expected 3 merged ranges, got %d", set.Len())
+	}
+
+	tests := []struct {
+		ip       string
+		contains bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.255", true},
+		{"192.168.2.0", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:10.0.0.1", true},
+	}
+	for _, tc := range tests {
+		if got := set.Contains(net.ParseIP(tc.ip)); got != tc.contains {
+			t.Errorf("Contains(%s) = %v, want %v", tc.ip, got, tc.contains)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{newRR("a.example. 300 IN CNAME b.example."), newRR("b.example. 300 IN A 10.0.0.1")}
+	if !set.Domestic(m) {
+		t.Error("expected answer to be domestic")
+	}
+	m.Answer = append(m.Answer, newRR("b.example. 300 IN A 8.8.8.8"))
+	if set.Domestic(m) {
+		t.Error("expected answer not to be domestic")
+	}
+}
+
+func newRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
@@ -0,0 +1,109 @@
+package bypass
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// Group is a named list of upstreams that queries can be routed to.
+type Group struct {
+	name       string
+	addrs      []string
+	transports []string
+	p          Policy
+	ecs        *ecsOption
+	via        *dialProxy // dial the upstreams through this proxy if set
+	bogus      *bogusFilter
+
+	// The properties of the proxies. When the group is built those it doesn't set are inherited.
+	upstreamOptions
+
+	declared bool // set once a group property defined the group
+
+	// Set when the group is built into the active upstreams.
+	proxies    []*Proxy
+	next       *Group // asked when every upstream of this group failed
+	bogusGroup *Group // asked instead when an answer is bogus, if that is the bogus action
+}
+
+// NewGroup returns a new, empty Group. Without a policy of its own the group uses the plugin's.
+func NewGroup(name string) *Group { return &Group{name: name} }
+
+// Name returns the name of the group.
+func (g *Group) Name() string { return g.name }
+
+// Len returns the number of upstreams in the group.
+func (g *Group) Len() int { return len(g.addrs) }
+
+// add parses hosts and appends them to the group. Proxies are only created when the group is built.
+func (g *Group) add(hosts ...string) error {
+	for _, host := range hosts {
+		// A DNS-over-HTTPS upstream may have a URL path, which is kept with the address.
+		path := ""
+		if trans, h := parse.Transport(host); trans == transport.HTTPS {
+			if i := strings.Index(h, "/"); i >= 0 {
+				host, path = transport.HTTPS+"://"+h[:i], h[i:]
+			}
+		}
+		toHosts, err := parse.HostPortOrFile(host)
+		if err != nil {
+			return err
+		}
+		for _, to := range toHosts {
+			trans, h := parse.Transport(to)
+			if trans == transport.HTTPS {
+				h += path
+			}
+			g.addrs = append(g.addrs, h)
+			g.transports = append(g.transports, trans)
+		}
+	}
+	return nil
+}
+
+// copy returns a copy of the group's configuration, without proxies.
+func (g *Group) copy() *Group {
+	c := *g
+	c.addrs = append([]string(nil), g.addrs...)
+	c.transports = append([]string(nil), g.transports...)
+	c.upstreamOptions = g.upstreamOptions.copy()
+	c.proxies, c.next, c.bogusGroup = nil, nil, nil
+	return &c
+}
+
+// key identifies a proxy of the built group by everything it is created with, a proxy with the same
+// key can be reused.
+func (g *Group) key(addr, trans string) string {
+	key := trans + "://" + addr + " expire=" + g.expire.String()
+	if g.via != nil {
+		key += " via=" + g.via.url.String()
+	}
+	if trans == transport.TLS || trans == transport.HTTPS {
+		key += " tls=" + strings.Join(g.tlsArgs, ",") + " servername=" + g.tlsServerName
+	}
+	if trans == transport.HTTPS {
+		key += " method=" + g.dohMethod
+	}
+	return key
+}
+
+// list returns the proxies of g ordered by the group's policy.
+func (g *Group) list() []*Proxy { return g.p.List(g.proxies) }
+
+// route sends names that match its rules to group, or answers them locally when action is a block
+// action. The domain lists built from its rules live in the rule set.
+type route struct {
+	rules  []string
+	group  string
+	action action
+}
+
+// apexRoute sends queries for the zone apex itself to the pass group.
+var apexRoute = &route{group: passGroup}
+
+const (
+	passGroup    = "pass"
+	forwardGroup = "forward"
+)
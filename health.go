@@ -1,6 +1,7 @@
 package bypass
 
 import (
+	"context"
 	"crypto/tls"
 	"sync/atomic"
 	"time"
@@ -29,6 +30,8 @@ func NewHealthChecker(trans string) HealthChecker {
 		c.WriteTimeout = 1 * time.Second
 
 		return &dnsHc{c: c}
+	case transport.HTTPS:
+		return &dohHc{}
 	}
 
 	log.Warningf("No healthchecker for transport %q", trans)
@@ -45,7 +48,12 @@ func (h *dnsHc) SetTLSConfig(cfg *tls.Config) {
 
 // Check is used as the up.Func in the up.Probe.
 func (h *dnsHc) Check(p *Proxy) error {
-	err := h.send(p.addr)
+	var err error
+	if p.transport.via != nil {
+		err = h.sendVia(p.transport)
+	} else {
+		err = h.send(p.addr)
+	}
 	if err != nil {
 		HealthcheckFailureCount.WithLabelValues(p.addr).Add(1)
 		atomic.AddUint32(&p.fails, 1)
@@ -71,3 +79,48 @@ func (h *dnsHc) send(addr string) error {
 
 	return err
 }
+
+// sendVia sends the health check query through the proxy of t, over TCP or TLS.
+func (h *dnsHc) sendVia(t *Transport) error {
+	proto := "tcp"
+	if t.tlsConfig != nil {
+		proto = "tcp-tls"
+	}
+	conn, err := t.dialVia(proto, hcTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ping := new(dns.Msg)
+	ping.SetQuestion(".", dns.TypeNS)
+	_, _, err = h.c.ExchangeWithConn(ping, conn)
+	return err
+}
+
+// dohHc is a health checker for a DNS-over-HTTPS endpoint. It sends the same query as dnsHc with
+// the proxy's own client, so it shares its connections and TLS config.
+type dohHc struct{}
+
+// SetTLSConfig is a noop, the proxy's client is configured instead.
+func (h *dohHc) SetTLSConfig(cfg *tls.Config) {}
+
+// Check is used as the up.Func in the up.Probe.
+func (h *dohHc) Check(p *Proxy) error {
+	ping := new(dns.Msg)
+	ping.SetQuestion(".", dns.TypeNS)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hcTimeout)
+	defer cancel()
+	if _, err := p.doh.exchange(ctx, ping); err != nil {
+		HealthcheckFailureCount.WithLabelValues(p.addr).Add(1)
+		atomic.AddUint32(&p.fails, 1)
+		return err
+	}
+
+	atomic.StoreUint32(&p.fails, 0)
+	return nil
+}
+
+// hcTimeout limits a health check that has to set up a connection through a proxy or over HTTPS first.
+const hcTimeout = 2 * time.Second
@@ -52,4 +52,88 @@ var (
 		Name:      "max_concurrent_rejects_total",
 		Help:      "Counter of the number of queries rejected because the concurrent queries were at maximum.",
 	})
+	FallbackCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "group_fallbacks_total",
+		Help:      "Counter of queries resent to the fallback group because every upstream of a group failed.",
+	}, []string{"from", "to"})
+	PoisonCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "poisoned_responses_total",
+		Help:      "Counter of suspect UDP replies dropped per upstream and reason.",
+	}, []string{"to", "reason"})
+	BogusAnswerCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "bogus_answers_total",
+		Help:      "Counter of answers with a bogus_ip address per group and the action taken.",
+	}, []string{"group", "action"})
+	RoutingSetSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "routing_set_entries",
+		Help:      "Gauge of the addresses in the routing set per group.",
+	}, []string{"group"})
+	RoutingSetDropCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "routing_set_drops_total",
+		Help:      "Counter of addresses not added to a full routing set per group.",
+	}, []string{"group"})
+	VerifyFallbackCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "verify_fallbacks_total",
+		Help:      "Counter of pass answers outside the verify set that were resent to the forward group.",
+	})
+	RaceWinCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "race_wins_total",
+		Help:      "Counter of race mode answers per group they were taken from.",
+	}, []string{"group"})
+	BlockCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "blocked_total",
+		Help:      "Counter of queries answered locally by a block rule, per action.",
+	}, []string{"action"})
+	RulesVersion = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "rules_version",
+		Help:      "Version of the active rule set, incremented on every successful load.",
+	})
+	RulesLoadTime = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "rules_loaded_timestamp_seconds",
+		Help:      "Unix time at which the active rule set was loaded.",
+	})
+	RouteCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "route_decisions_total",
+		Help:      "Counter of routing decisions per group, action and category of the matching rule.",
+	}, []string{"group", "action", "category"})
+	RuleSetSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "rule_entries",
+		Help:      "Gauge of the entries in the active rule set per list, route or exclude, and rule category.",
+	}, []string{"list", "category"})
+	ReloadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "reloads_total",
+		Help:      "Counter of rule and upstream loads per result.",
+	}, []string{"what", "result"})
+	ReloadTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "bypass",
+		Name:      "reload_timestamp_seconds",
+		Help:      "Unix time of the last rule or upstream load per result.",
+	}, []string{"what", "result"})
 )
@@ -22,11 +22,13 @@ type Transport struct {
 	expire      time.Duration             // After this duration a connection is expired.
 	addr        string
 	tlsConfig   *tls.Config
+	via         *dialProxy // dial through this proxy if set
 
 	dial  chan string
 	yield chan *dns.Conn
 	ret   chan *dns.Conn
 	stop  chan bool
+	sizes chan chan map[string]int
 }
 
 func newTransport(addr string) *Transport {
@@ -39,6 +41,7 @@ func newTransport(addr string) *Transport {
 		yield:       make(chan *dns.Conn),
 		ret:         make(chan *dns.Conn),
 		stop:        make(chan bool),
+		sizes:       make(chan chan map[string]int),
 	}
 	return t
 }
@@ -96,6 +99,13 @@ Wait:
 
 			t.conns["tcp-tls"] = append(t.conns["tcp-tls"], &persistConn{conn, time.Now()})
 
+		case ch := <-t.sizes:
+			sizes := make(map[string]int, len(t.conns))
+			for proto, conns := range t.conns {
+				sizes[proto] = len(conns)
+			}
+			ch <- sizes
+
 		case <-ticker.C:
 			t.cleanup(false)
 
@@ -143,6 +153,19 @@ func (t *Transport) cleanup(all bool) {
 	}
 }
 
+// Sizes returns the number of cached connections per protocol. It returns nil if the connection
+// manager doesn't answer, i.e. when it isn't running.
+func (t *Transport) Sizes() map[string]int {
+	ch := make(chan map[string]int, 1)
+	select {
+	case t.sizes <- ch:
+		return <-ch
+	case <-t.stop:
+	case <-time.After(time.Second):
+	}
+	return nil
+}
+
 // Yield return the connection to transport for reuse.
 func (t *Transport) Yield(c *dns.Conn) { t.yield <- c }
 
@@ -158,6 +181,9 @@ func (t *Transport) SetExpire(expire time.Duration) { t.expire = expire }
 // SetTLSConfig sets the TLS config in transport.
 func (t *Transport) SetTLSConfig(cfg *tls.Config) { t.tlsConfig = cfg }
 
+// SetDialProxy makes transport dial its connections through d.
+func (t *Transport) SetDialProxy(d *dialProxy) { t.via = d }
+
 const (
 	defaultExpire  = 10 * time.Second
 	minDialTimeout = 1 * time.Second
@@ -0,0 +1,236 @@
+package bypass
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// antiPoison guards queries sent to an upstream over plain UDP against replies injected by someone on
+// the path, who tends to answer before the real server does.
+type antiPoison struct {
+	bogus         *IPSet        // replies with an address in here are dropped
+	window        time.Duration // after a reply, wait this long for a later one that replaces it
+	randomizeCase bool          // send the name in random case and require it echoed (DNS 0x20)
+}
+
+// parseAntiPoison parses an anti_poison property, nil means it is switched off:
+//
+//	anti_poison [off] {
+//	    bogus IP|CIDR|FILE...
+//	    window DURATION
+//	    randomize_case
+//	}
+//
+// Without a block only randomize_case is on.
+func parseAntiPoison(c *caddyfile.Dispenser) (*antiPoison, error) {
+	ap := &antiPoison{}
+	if !c.NextArg() {
+		ap.randomizeCase = true
+		return ap, nil
+	}
+	if c.Val() == "off" {
+		if c.NextArg() {
+			return nil, c.ArgErr()
+		}
+		return nil, nil
+	}
+	if c.Val() != "{" {
+		return nil, c.SyntaxErr("{")
+	}
+	for c.Next() {
+		switch c.Val() {
+		case "}":
+			if ap.bogus == nil && ap.window == 0 && !ap.randomizeCase {
+				return nil, c.Err("anti_poison block checks nothing")
+			}
+			return ap, nil
+		case "bogus":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			set, err := parseIPList(args)
+			if err != nil {
+				return nil, err
+			}
+			ap.bogus = set
+		case "window":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			dur, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, err
+			}
+			if dur < 0 || dur >= readTimeout {
+				return nil, c.Errf("window must be between 0 and %s: %s", readTimeout, dur)
+			}
+			ap.window = dur
+		case "randomize_case":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			ap.randomizeCase = true
+		default:
+			return nil, c.Errf("unknown anti_poison property '%s'", c.Val())
+		}
+	}
+	return nil, c.EOFErr()
+}
+
+// parseIPList returns the set of the addresses and CIDRs in args. An argument that is neither is
+// read as a file with one address or CIDR per line, text after a # is a comment.
+func parseIPList(args []string) (*IPSet, error) {
+	var nets []*net.IPNet
+	add := func(s string) bool {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			return true
+		}
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, n)
+			return true
+		}
+		return false
+	}
+	for _, arg := range args {
+		if add(arg) {
+			continue
+		}
+		f, err := os.Open(arg)
+		if err != nil {
+			return nil, fmt.Errorf("not an IP address, CIDR or file: %q", arg)
+		}
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			if !add(line) {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: not an IP address or CIDR: %q", arg, n, line)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewIPSet(nets), nil
+}
+
+// prepare returns the request to send for req: a copy with the name in random case when case
+// randomization is on, req itself otherwise.
+func (ap *antiPoison) prepare(req *dns.Msg) *dns.Msg {
+	if !ap.randomizeCase || len(req.Question) == 0 {
+		return req
+	}
+	m := req.Copy()
+	name := []byte(m.Question[0].Name)
+	first, flipped := -1, false
+	for i, c := range name {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			if first < 0 {
+				first = i
+			}
+			if rand.Intn(2) == 0 {
+				name[i] ^= 0x20
+				flipped = true
+			}
+		}
+	}
+	// Change at least one letter, a name sent as it is proves nothing.
+	if !flipped && first >= 0 {
+		name[first] ^= 0x20
+	}
+	m.Question[0].Name = string(name)
+	return m
+}
+
+// check returns why ret, a reply to the request sent, is suspect, or the empty string if it isn't.
+func (ap *antiPoison) check(sent, ret *dns.Msg) string {
+	if ap.randomizeCase && len(sent.Question) > 0 && (len(ret.Question) == 0 || ret.Question[0].Name != sent.Question[0].Name) {
+		return "case_mismatch"
+	}
+	if ap.bogus != nil && ap.bogus.Find(ret) != nil {
+		return "bogus_ip"
+	}
+	return ""
+}
+
+// restoreCase gives the names in ret, a reply to the request sent, the case they have in req.
+func restoreCase(req, sent, ret *dns.Msg) {
+	if sent == req || len(ret.Question) == 0 {
+		return
+	}
+	name, mixed := req.Question[0].Name, sent.Question[0].Name
+	ret.Question[0].Name = name
+	for _, rrs := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Name == mixed {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
+
+// readGuarded reads the replies to sent from the UDP connection conn and drops the suspect ones.
+// After the first acceptable reply it keeps listening for the window of ap, a later acceptable
+// reply replaces it, as the real server is the slower one. If only suspect replies arrive before
+// the read deadline errPoisoned is returned.
+func (p *Proxy) readGuarded(conn *dns.Conn, sent *dns.Msg, ap *antiPoison) (*dns.Msg, error) {
+	var good *dns.Msg
+	suspect := false
+	for {
+		ret, err := conn.ReadMsg()
+		if err != nil {
+			if good != nil {
+				return good, nil
+			}
+			var nerr net.Error
+			if suspect && errors.As(err, &nerr) && nerr.Timeout() {
+				return nil, errPoisoned
+			}
+			return nil, err
+		}
+		// drop out-of-order responses
+		if ret.Id != sent.Id {
+			continue
+		}
+		if reason := ap.check(sent, ret); reason != "" {
+			PoisonCount.WithLabelValues(p.addr, reason).Add(1)
+			suspect = true
+			continue
+		}
+		if good != nil {
+			PoisonCount.WithLabelValues(p.addr, "superseded").Add(1)
+		}
+		if ap.window == 0 {
+			return ret, nil
+		}
+		if good == nil {
+			conn.SetReadDeadline(time.Now().Add(ap.window))
+		}
+		good = ret
+	}
+}
+
+var errPoisoned = errors.New("only suspect replies received")
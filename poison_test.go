@@ -0,0 +1,128 @@
+package bypass
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// injectingServer answers every query twice over UDP: first right away with a forged reply from
+// forge, then after a while with the real reply, which has address 192.0.2.1.
+func injectingServer(t *testing.T, forge func(q *dns.Msg) *dns.Msg) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if q.Unpack(buf[:n]) != nil {
+				continue
+			}
+			out, _ := forge(q).Pack()
+			pc.WriteTo(out, addr)
+			time.Sleep(20 * time.Millisecond)
+			out, _ = reply(q, "192.0.2.1").Pack()
+			pc.WriteTo(out, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func reply(q *dns.Msg, ip string) *dns.Msg {
+	ret := new(dns.Msg)
+	ret.SetReply(q)
+	ret.Answer = append(ret.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	})
+	return ret
+}
+
+func TestAntiPoison(t *testing.T) {
+	bogus, err := parseIPList([]string{"10.0.0.0/8", "203.0.113.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower := func(q *dns.Msg) *dns.Msg {
+		m := q.Copy()
+		m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+		return reply(m, "198.51.100.1")
+	}
+	tests := []struct {
+		name  string
+		forge func(q *dns.Msg) *dns.Msg
+		ap    *antiPoison
+	}{
+		{"bogus", func(q *dns.Msg) *dns.Msg { return reply(q, "10.1.2.3") }, &antiPoison{bogus: bogus}},
+		{"window", func(q *dns.Msg) *dns.Msg { return reply(q, "198.51.100.1") }, &antiPoison{window: 200 * time.Millisecond}},
+		{"case", lower, &antiPoison{randomizeCase: true}},
+	}
+	for _, tc := range tests {
+		p := NewProxy(injectingServer(t, tc.forge), transport.DNS)
+		p.start(hcInterval)
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: m}
+		ret, err := p.Connect(context.Background(), state, options{poison: tc.ap})
+		p.close()
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Errorf("%s: got forged reply %v", tc.name, ret.Answer)
+		}
+		if ret.Question[0].Name != "www.example.org." || ret.Answer[0].Header().Name != "www.example.org." {
+			t.Errorf("%s: case not restored: %s", tc.name, ret.Question[0].Name)
+		}
+	}
+}
+
+func TestParseAntiPoison(t *testing.T) {
+	tests := []struct {
+		input string
+		want  *antiPoison
+		err   bool
+	}{
+		{input: "anti_poison", want: &antiPoison{randomizeCase: true}},
+		{input: "anti_poison off"},
+		{input: "anti_poison {\n window 100ms\n}", want: &antiPoison{window: 100 * time.Millisecond}},
+		{input: "anti_poison {\n}", err: true},
+		{input: "anti_poison off now", err: true},
+		{input: "anti_poison {\n window 5s\n}", err: true},
+	}
+	for _, tc := range tests {
+		c := caddyfile.NewDispenser("test", strings.NewReader(tc.input))
+		c.Next()
+		ap, err := parseAntiPoison(&c)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.input, err)
+			continue
+		}
+		if (ap == nil) != (tc.want == nil) || ap != nil && *ap != *tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.input, ap, tc.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/coredns/coredns/plugin/pkg/transport"
 	"github.com/coredns/coredns/plugin/pkg/up"
 )
 
@@ -19,18 +20,27 @@ type Proxy struct {
 	expire    time.Duration
 	transport *Transport
 
+	doh *dohClient // set for DNS-over-HTTPS upstreams instead of using transport
+
 	// health checking
 	probe  *up.Probe
 	health HealthChecker
 }
 
-// NewProxy returns a new proxy.
+// NewProxy returns a new proxy. The address of a DNS-over-HTTPS proxy may include the URL path.
 func NewProxy(addr, trans string) *Proxy {
+	var doh *dohClient
+	if trans == transport.HTTPS {
+		var path string
+		addr, path = splitDoHPath(addr)
+		doh = newDoHClient(addr, path)
+	}
 	p := &Proxy{
 		addr:      addr,
 		fails:     0,
 		probe:     up.New(),
 		transport: newTransport(addr),
+		doh:       doh,
 	}
 	p.health = NewHealthChecker(trans)
 	runtime.SetFinalizer(p, (*Proxy).finalizer)
@@ -39,12 +49,39 @@ func NewProxy(addr, trans string) *Proxy {
 
 // SetTLSConfig sets the TLS config in the lower p.transport and in the healthchecking client.
 func (p *Proxy) SetTLSConfig(cfg *tls.Config) {
+	if p.doh != nil {
+		p.doh.tlsConfig = cfg
+		p.doh.configure()
+		return
+	}
 	p.transport.SetTLSConfig(cfg)
 	p.health.SetTLSConfig(cfg)
 }
 
 // SetExpire sets the expire duration in the lower p.transport.
-func (p *Proxy) SetExpire(expire time.Duration) { p.transport.SetExpire(expire) }
+func (p *Proxy) SetExpire(expire time.Duration) {
+	p.transport.SetExpire(expire)
+	if p.doh != nil {
+		p.doh.expire = expire
+		p.doh.configure()
+	}
+}
+
+// SetDialProxy makes p dial its connections, including those for health checks, through d.
+func (p *Proxy) SetDialProxy(d *dialProxy) {
+	p.transport.SetDialProxy(d)
+	if p.doh != nil {
+		p.doh.via = d
+		p.doh.configure()
+	}
+}
+
+// SetDoHMethod sets the HTTP method, GET or POST, of a DNS-over-HTTPS proxy.
+func (p *Proxy) SetDoHMethod(method string) {
+	if p.doh != nil {
+		p.doh.method = method
+	}
+}
 
 // Healthcheck kicks of a round of health checks for this proxy.
 func (p *Proxy) Healthcheck() {
@@ -0,0 +1,68 @@
+package bypass
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// raceResult is the outcome of an exchange with one group.
+type raceResult struct {
+	ret    *dns.Msg
+	from   *Group // the group that answered
+	taperr error
+	err    error
+}
+
+// raceGroups sends the query to the pass and default groups at the same time. The pass answer is
+// taken when the name matched or the answer is domestic according to the verify set, otherwise the
+// default group's answer is used. A group that doesn't answer within its timeout is treated as failed.
+// The group that answered is returned in from.
+func (b *Bypass) raceGroups(ctx context.Context, state request.Request, rs *ruleSet, pass, def *Group, match bool) (ret *dns.Msg, from *Group, taperr, err error) {
+	pch := b.raceGroup(ctx, state, pass, b.passTimeout)
+	fch := b.raceGroup(ctx, state, def, b.forwardTimeout)
+
+	p := waitRace(pch, b.passTimeout)
+	if p.err == nil && (match || (rs.verify != nil && rs.verify.Domestic(p.ret))) {
+		RaceWinCount.WithLabelValues(p.from.name).Add(1)
+		return p.ret, p.from, p.taperr, nil
+	}
+
+	f := waitRace(fch, b.forwardTimeout)
+	if f.err == nil {
+		RaceWinCount.WithLabelValues(f.from.name).Add(1)
+		return f.ret, f.from, f.taperr, nil
+	}
+	if p.err == nil {
+		// Better a pass answer we couldn't confirm than no answer at all.
+		RaceWinCount.WithLabelValues(p.from.name).Add(1)
+		return p.ret, p.from, p.taperr, nil
+	}
+	return nil, nil, nil, f.err
+}
+
+// raceGroup starts an exchange with g in the background. Each group gets its own copy of the
+// request so they can't interfere with each other.
+func (b *Bypass) raceGroup(ctx context.Context, state request.Request, g *Group, timeout time.Duration) <-chan raceResult {
+	ch := make(chan raceResult, 1)
+	st := request.Request{W: state.W, Req: state.Req.Copy()}
+	go func() {
+		ret, from, taperr, err := b.resolve(ctx, st, g, timeout)
+		ch <- raceResult{ret: ret, from: from, taperr: taperr, err: err}
+	}()
+	return ch
+}
+
+// waitRace waits for the result on ch for at most timeout.
+func waitRace(ch <-chan raceResult, timeout time.Duration) raceResult {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r
+	case <-timer.C:
+		return raceResult{err: errRaceTimeout}
+	}
+}
@@ -0,0 +1,96 @@
+package bypass
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowServer is udpServer answering after delay.
+func slowServer(t *testing.T, ip string, delay time.Duration) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(delay)
+		w.WriteMsg(reply(r, ip))
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestRaceGroups(t *testing.T) {
+	// Nothing listens on dead.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := pc.LocalAddr().String()
+	pc.Close()
+
+	domestic, foreign := udpServer(t, "192.0.2.1"), udpServer(t, "198.51.100.1")
+	slow := slowServer(t, "192.0.2.1", 300*time.Millisecond)
+	cfg, err := parseUpstreams(`group pass ` + domestic + `
+group forward ` + foreign + `
+group poisoned ` + foreign + `
+group slow ` + slow + `
+group dead ` + dead + `
+group backup ` + domestic + `
+fallback dead -> backup
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.checkFallbacks(); err != nil {
+		t.Fatal(err)
+	}
+	b := New()
+	b.race, b.passTimeout, b.forwardTimeout = true, 100*time.Millisecond, time.Second
+	up := cfg.build(nil)
+	b.up.Store(up)
+	for _, p := range up.proxies {
+		p.start(hcInterval)
+		defer p.close()
+	}
+	rs := newRuleSet()
+	if rs.verify, err = parseIPList([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pass  string
+		match bool
+		from  string
+	}{
+		{"pass", false, "pass"},        // domestic answer
+		{"poisoned", false, "forward"}, // foreign answer, not confirmed
+		{"poisoned", true, "poisoned"}, // matched names take the pass answer as is
+		{"slow", false, "forward"},     // too late
+		{"dead", false, "backup"},      // answered by the fallback group
+	}
+	for _, tc := range tests {
+		before := testutil.ToFloat64(RaceWinCount.WithLabelValues(tc.from))
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: m}
+		_, from, _, err := b.raceGroups(context.Background(), state, rs, up.groups[tc.pass], up.groups[forwardGroup], tc.match)
+		if err != nil {
+			t.Errorf("%s: %s", tc.pass, err)
+			continue
+		}
+		if from.name != tc.from {
+			t.Errorf("%s: answered by %s, want %s", tc.pass, from.name, tc.from)
+		}
+		if n := testutil.ToFloat64(RaceWinCount.WithLabelValues(tc.from)) - before; n != 1 {
+			t.Errorf("%s: race win of %s counted %v times", tc.pass, tc.from, n)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package bypass
 
 import (
+	"fmt"
 	"io/ioutil"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/golang/protobuf/proto"
@@ -11,129 +14,382 @@ import (
 
 //DomainList ...
 type DomainList struct {
-	s map[[16]byte]struct{}
-	m map[[32]byte]struct{}
-	l map[[256]byte]struct{}
+	suffixes domainSet
+	full     domainSet
+	keywords []string
+	regexps  []*regexp.Regexp
+
+	sources []listSource
+}
+
+// listSource is a rule, e.g. geosite:cn, whose entries were added after those of the source before
+// it, so the entries of each source are a contiguous range.
+type listSource struct {
+	name           string
+	suffix, full   int // arena offsets of the first entries
+	keyword, regex int // indexes of the first entries
+	count          int
 }
 
 //NewDomainList ...
 func NewDomainList() *DomainList {
-	return &DomainList{
-		s: make(map[[16]byte]struct{}),
-		m: make(map[[32]byte]struct{}),
-		l: make(map[[256]byte]struct{}),
+	return &DomainList{}
+}
+
+// AddDomain adds a v2ray domain rule, dispatching on its type.
+func (l *DomainList) AddDomain(d *router.Domain) error {
+	switch d.GetType() {
+	case router.Domain_Domain:
+		l.Add(d.GetValue())
+	case router.Domain_Full:
+		l.AddFull(d.GetValue())
+	case router.Domain_Plain:
+		l.AddKeyword(d.GetValue())
+	case router.Domain_Regex:
+		return l.AddRegex(d.GetValue())
+	default:
+		return fmt.Errorf("unknown domain type: %s", d.GetType())
 	}
+	return nil
 }
 
-//Add ...
+// Add adds a domain that matches itself and all of its subdomains.
 func (l *DomainList) Add(fqdn string) {
-	n := len(fqdn)
-
-	switch {
-	case n <= 16:
-		var b [16]byte
-		copy(b[:], fqdn)
-		l.s[b] = struct{}{}
-	case n <= 32:
-		var b [32]byte
-		copy(b[:], fqdn)
-		l.m[b] = struct{}{}
-	default:
-		var b [256]byte
-		copy(b[:], fqdn)
-		l.l[b] = struct{}{}
+	if l.suffixes.add(dns.Fqdn(strings.ToLower(fqdn))) {
+		l.count()
+	}
+}
+
+// AddFull adds a domain that only matches itself.
+func (l *DomainList) AddFull(fqdn string) {
+	if l.full.add(dns.Fqdn(strings.ToLower(fqdn))) {
+		l.count()
+	}
+}
+
+// AddKeyword adds a keyword that matches any domain containing it.
+func (l *DomainList) AddKeyword(keyword string) {
+	l.keywords = append(l.keywords, strings.ToLower(keyword))
+	l.count()
+}
+
+// AddRegex adds a regular expression that is matched against the domain
+// without its trailing dot.
+func (l *DomainList) AddRegex(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
 	}
+	l.regexps = append(l.regexps, re)
+	l.count()
+	return nil
+}
+
+// from starts a new source, the entries added after it are reported as added from name.
+func (l *DomainList) from(name string) {
+	l.sources = append(l.sources, listSource{
+		name:    name,
+		suffix:  len(l.suffixes.arena),
+		full:    len(l.full.arena),
+		keyword: len(l.keywords),
+		regex:   len(l.regexps),
+	})
+}
+
+// count counts an entry added to the current source.
+func (l *DomainList) count() {
+	if n := len(l.sources); n > 0 {
+		l.sources[n-1].count++
+	}
+}
+
+// source returns the name of the source of the entry at pos, start returns where a source begins.
+func (l *DomainList) source(pos int, start func(listSource) int) string {
+	i := sort.Search(len(l.sources), func(i int) bool { return start(l.sources[i]) > pos })
+	if i == 0 {
+		return ""
+	}
+	return l.sources[i-1].name
+}
+
+// Counts returns the number of entries added from each source. A domain in several sources is only
+// counted for the first.
+func (l *DomainList) Counts() map[string]int {
+	counts := make(map[string]int, len(l.sources))
+	for _, src := range l.sources {
+		counts[src.name] += src.count
+	}
+	return counts
 }
 
 //Has ...
 func (l *DomainList) Has(fqdn string) bool {
+	_, _, ok := l.lookup(fqdn)
+	return ok
+}
+
+// Match returns the rule fqdn matches, e.g. "domain:example.com", and the source it was added
+// from, e.g. "geosite:cn".
+func (l *DomainList) Match(fqdn string) (rule, source string, ok bool) {
+	typ, pos, ok := l.lookup(fqdn)
+	if !ok {
+		return "", "", false
+	}
+	switch typ {
+	case router.Domain_Full:
+		rule = "full:" + l.full.name(pos)
+	case router.Domain_Domain:
+		rule = "domain:" + l.suffixes.name(pos)
+	case router.Domain_Plain:
+		rule = "keyword:" + l.keywords[pos]
+	default:
+		rule = "regexp:" + l.regexps[pos].String()
+	}
+	return rule, l.sourceOf(typ, pos), true
+}
+
+// matchSource returns the source of the rule fqdn matches, without building the rule itself.
+func (l *DomainList) matchSource(fqdn string) (string, bool) {
+	typ, pos, ok := l.lookup(fqdn)
+	if !ok {
+		return "", false
+	}
+	return l.sourceOf(typ, pos), true
+}
+
+// sourceOf returns the source of the rule of type typ kept at pos.
+func (l *DomainList) sourceOf(typ router.Domain_Type, pos int) string {
+	switch typ {
+	case router.Domain_Full:
+		return l.source(pos, func(s listSource) int { return s.full })
+	case router.Domain_Domain:
+		return l.source(pos, func(s listSource) int { return s.suffix })
+	case router.Domain_Plain:
+		return l.source(pos, func(s listSource) int { return s.keyword })
+	default:
+		return l.source(pos, func(s listSource) int { return s.regex })
+	}
+}
+
+// lookup returns the type of the rule fqdn matches and where it is kept: the arena offset for full
+// and domain rules, the index for keywords and regular expressions.
+func (l *DomainList) lookup(fqdn string) (router.Domain_Type, int, bool) {
 	if fqdn == "." {
+		return 0, 0, false
+	}
+	if pos, ok := l.full.lookup(fqdn); ok {
+		return router.Domain_Full, pos, true
+	}
+	if l.suffixes.n > 0 {
+		off, end := 0, false
+		for !end {
+			if pos, ok := l.suffixes.lookup(fqdn[off:]); ok {
+				return router.Domain_Domain, pos, true
+			}
+			off, end = dns.NextLabel(fqdn, off)
+		}
+	}
+	if len(l.keywords) == 0 && len(l.regexps) == 0 {
+		return 0, 0, false
+	}
+	domain := strings.TrimSuffix(fqdn, ".")
+	for i, keyword := range l.keywords {
+		if strings.Contains(domain, keyword) {
+			return router.Domain_Plain, i, true
+		}
+	}
+	for i, re := range l.regexps {
+		if re.MatchString(domain) {
+			return router.Domain_Regex, i, true
+		}
+	}
+	return 0, 0, false
+}
+
+//Len ...
+func (l *DomainList) Len() int {
+	return l.suffixes.n + l.full.n + len(l.keywords) + len(l.regexps)
+}
+
+// domainSet is an open addressing hash set of domain names. The names are
+// packed into one arena, each prefixed by its length and stored without the
+// trailing dot, and the table only holds offsets into it. An entry costs
+// little more than the name itself and lookups don't allocate.
+type domainSet struct {
+	slots []uint32 // arena offset + 1, 0 is an empty slot
+	arena []byte
+	n     int
+}
+
+// add adds fqdn and returns true if it wasn't in the set yet.
+func (s *domainSet) add(fqdn string) bool {
+	name := strings.TrimSuffix(fqdn, ".")
+	if len(name) > 255 {
+		// Longer than any valid domain name, so it can never match.
 		return false
 	}
-	idx := make([]int, 1, 6)
-	off := 0
-	end := false
+	if (s.n+1)*4 > len(s.slots)*3 {
+		s.grow()
+	}
+	i, ok := s.find(name)
+	if ok {
+		return false
+	}
+	s.slots[i] = uint32(len(s.arena)) + 1
+	s.arena = append(s.arena, byte(len(name)))
+	s.arena = append(s.arena, name...)
+	s.n++
+	return true
+}
 
-	for {
-		off, end = dns.NextLabel(fqdn, off)
-		if end {
-			break
-		}
-		idx = append(idx, off)
+// lookup returns the arena offset of fqdn.
+func (s *domainSet) lookup(fqdn string) (int, bool) {
+	if s.n == 0 {
+		return 0, false
+	}
+	i, ok := s.find(strings.TrimSuffix(fqdn, "."))
+	if !ok {
+		return 0, false
 	}
+	return int(s.slots[i] - 1), true
+}
+
+// name returns the name at arena offset off.
+func (s *domainSet) name(off int) string {
+	n := int(s.arena[off])
+	return string(s.arena[off+1 : off+1+n])
+}
 
-	for i := range idx {
-		p := idx[len(idx)-1-i]
-		if l.has(fqdn[p:]) {
-			return true
+// find returns the slot holding name, or the empty slot where it belongs.
+func (s *domainSet) find(name string) (uint64, bool) {
+	mask := uint64(len(s.slots) - 1)
+	for i := hashName(name) & mask; ; i = (i + 1) & mask {
+		off := s.slots[i]
+		if off == 0 {
+			return i, false
+		}
+		if s.equal(off-1, name) {
+			return i, true
 		}
 	}
-	return false
 }
 
-func (l *DomainList) has(fqdn string) bool {
-	n := len(fqdn)
-	switch {
-	case n <= 16:
-		var b [16]byte
-		copy(b[:], fqdn)
-		_, ok := l.s[b]
-		return ok
-	case n <= 32:
-		var b [32]byte
-		copy(b[:], fqdn)
-		_, ok := l.m[b]
-		return ok
-	default:
-		var b [256]byte
-		copy(b[:], fqdn)
-		_, ok := l.l[b]
-		return ok
+func (s *domainSet) equal(off uint32, name string) bool {
+	n := uint32(s.arena[off])
+	return int(n) == len(name) && string(s.arena[off+1:off+1+n]) == name
+}
+
+func (s *domainSet) grow() {
+	size := 2 * len(s.slots)
+	if size == 0 {
+		size = 8
+	}
+	slots := make([]uint32, size)
+	mask := uint64(size - 1)
+	for _, off := range s.slots {
+		if off == 0 {
+			continue
+		}
+		n := uint32(s.arena[off-1])
+		i := hashName(string(s.arena[off : off+n]))
+		for ; slots[i&mask] != 0; i++ {
+		}
+		slots[i&mask] = off
 	}
+	s.slots = slots
 }
 
-//Len ...
-func (l *DomainList) Len() int {
-	return len(l.l) + len(l.m) + len(l.s)
+// hashName is 64 bit FNV-1a.
+func hashName(name string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= 1099511628211
+	}
+	return h
 }
 
-func loadGeoSiteData(path string, domains []string) (*DomainList, error) {
-	include := NewDomainList()
-	geositeData, err := ioutil.ReadFile(path)
+// LoadGeoSite reads the geosite file at path.
+func LoadGeoSite(path string) (*router.GeoSiteList, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 	geosite := new(router.GeoSiteList)
-	if err := proto.Unmarshal(geositeData, geosite); err != nil {
+	if err := proto.Unmarshal(data, geosite); err != nil {
 		return nil, err
 	}
+	return geosite, nil
+}
+
+// LoadDomainList builds a DomainList from rules such as geosite:cn or domain:example.com, the
+// way include and exclude do. Geosite rules are looked up in the geosite file at path.
+func LoadDomainList(path string, rules []string) (*DomainList, error) {
+	geosite, err := loadGeoSiteFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return loadGeoSiteData(geosite, rules)
+}
+
+// loadGeoSiteFile reads the geosite file at path, an empty path gives an empty list.
+func loadGeoSiteFile(path string) (*router.GeoSiteList, error) {
+	if path == "" {
+		return new(router.GeoSiteList), nil
+	}
+	return LoadGeoSite(path)
+}
+
+func loadGeoSiteData(geosite *router.GeoSiteList, domains []string) (*DomainList, error) {
+	include := NewDomainList()
 	for _, domain := range domains {
+		include.from(domain)
 		rules, err := parseDomainRule(geosite, domain)
 		if err != nil {
 			return nil, err
 		}
 		for _, rule := range rules {
-			if !include.Has(rule.Value) {
-				include.Add(rule.Value)
-
+			if err := include.AddDomain(rule); err != nil {
+				return nil, err
 			}
 		}
-
 	}
 	return include, nil
+}
 
+// DomainRules returns the domains a single rule such as geosite:cn@!ads stands for.
+func DomainRules(geosite *router.GeoSiteList, rule string) ([]*router.Domain, error) {
+	return parseDomainRule(geosite, rule)
 }
 
 func parseDomainRule(geosite *router.GeoSiteList, domain string) ([]*router.Domain, error) {
 	var domains []*router.Domain
 	if strings.HasPrefix(domain, "geosite:") {
-		country := strings.ToUpper(domain[8:])
+		if len(geosite.GetEntry()) == 0 {
+			return nil, fmt.Errorf("no geosite data loaded for %q", domain)
+		}
+		country, attrs, err := parseAttributes(domain[8:])
+		if err != nil {
+			return nil, err
+		}
+		country = strings.ToUpper(country)
 		for _, entry := range geosite.GetEntry() {
-			if country == entry.GetCountryCode() {
-				domains = append(domains, entry.GetDomain()...)
+			if country != entry.GetCountryCode() {
+				continue
+			}
+			for _, d := range entry.GetDomain() {
+				if attrs.Match(d) {
+					domains = append(domains, d)
+				}
 			}
 		}
 	}
+	if strings.HasPrefix(domain, "file:") {
+		return loadDomainFile(domain[5:])
+	}
+	if strings.HasPrefix(domain, "dnsmasq:") {
+		return loadDnsmasqFile(domain[8:])
+	}
 	if strings.HasPrefix(domain, "domain:") {
 		domains = append(domains, &router.Domain{
 			Type:      router.Domain_Domain,
@@ -141,5 +397,71 @@ func parseDomainRule(geosite *router.GeoSiteList, domain string) ([]*router.Doma
 			Attribute: nil,
 		})
 	}
+	if strings.HasPrefix(domain, "full:") {
+		domains = append(domains, &router.Domain{
+			Type:  router.Domain_Full,
+			Value: domain[5:],
+		})
+	}
+	if strings.HasPrefix(domain, "keyword:") {
+		domains = append(domains, &router.Domain{
+			Type:  router.Domain_Plain,
+			Value: domain[8:],
+		})
+	}
+	if strings.HasPrefix(domain, "regexp:") {
+		domains = append(domains, &router.Domain{
+			Type:  router.Domain_Regex,
+			Value: domain[7:],
+		})
+	}
 	return domains, nil
 }
+
+// attributeMatcher selects geosite domains by attribute, e.g. "cn" or "!cn".
+type attributeMatcher struct {
+	key    string
+	negate bool
+}
+
+// Match returns true if d carries the attribute, or lacks it when negated.
+func (m attributeMatcher) Match(d *router.Domain) bool {
+	for _, attr := range d.GetAttribute() {
+		if strings.EqualFold(attr.GetKey(), m.key) {
+			return !m.negate
+		}
+	}
+	return m.negate
+}
+
+// attributeMatchers is a list of matchers that must all match.
+type attributeMatchers []attributeMatcher
+
+// Match returns true if every matcher matches d.
+func (ms attributeMatchers) Match(d *router.Domain) bool {
+	for _, m := range ms {
+		if !m.Match(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseAttributes splits a selector such as "google@cn@!ads" into the
+// category name and its attribute matchers.
+func parseAttributes(s string) (string, attributeMatchers, error) {
+	parts := strings.Split(s, "@")
+	var attrs attributeMatchers
+	for _, p := range parts[1:] {
+		m := attributeMatcher{key: strings.ToLower(strings.TrimSpace(p))}
+		if strings.HasPrefix(m.key, "!") {
+			m.key = m.key[1:]
+			m.negate = true
+		}
+		if m.key == "" {
+			return "", nil, fmt.Errorf("empty attribute in %q", s)
+		}
+		attrs = append(attrs, m)
+	}
+	return strings.TrimSpace(parts[0]), attrs, nil
+}
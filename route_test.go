@@ -1 +1,351 @@
 package bypass
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"v2ray.com/core/app/router"
+)
+
+func TestDomainListHas(t *testing.T) {
+	l := NewDomainList()
+	rules := []*router.Domain{
+		{Type: router.Domain_Domain, Value: "example.com"},
+		{Type: router.Domain_Full, Value: "full.example.org"},
+		{Type: router.Domain_Plain, Value: "keyword"},
+		{Type: router.Domain_Regex, Value: `^cdn\d+\.example\.net$`},
+	}
+	for _, r := range rules {
+		if err := l.AddDomain(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		has  bool
+	}{
+		{"example.com.", true},
+		{"www.example.com.", true},
+		{"notexample.com.", false},
+		{"full.example.org.", true},
+		{"www.full.example.org.", false},
+		{"a-keyword-domain.io.", true},
+		{"cdn42.example.net.", true},
+		{"cdn.example.net.", false},
+		{".", false},
+	}
+	for _, tc := range tests {
+		if got := l.Has(tc.name); got != tc.has {
+			t.Errorf("Has(%q) = %v, want %v", tc.name, got, tc.has)
+		}
+	}
+}
+
+func TestDomainListGrow(t *testing.T) {
+	l := NewDomainList()
+	for i := 0; i < 1000; i++ {
+		l.Add(fmt.Sprintf("d%d.example.com", i))
+		l.Add(fmt.Sprintf("D%d.Example.com.", i))
+	}
+	if l.Len() != 1000 {
+		t.Errorf("Len() = %d, want 1000", l.Len())
+	}
+	for i := 0; i < 1000; i++ {
+		if name := fmt.Sprintf("www.d%d.example.com.", i); !l.Has(name) {
+			t.Errorf("Has(%q) = false, want true", name)
+		}
+	}
+	if l.Has("example.com.") {
+		t.Error("Has(\"example.com.\") = true, want false")
+	}
+}
+
+func TestDomainListMatch(t *testing.T) {
+	l := NewDomainList()
+	l.from("list:a")
+	l.Add("example.com")
+	l.AddKeyword("ads")
+	l.from("list:b")
+	l.Add("example.com")
+	l.AddFull("www.example.org")
+	if err := l.AddRegex(`^cdn\d+\.`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, rule, source string
+	}{
+		{"a.example.com.", "domain:example.com", "list:a"},
+		{"www.example.org.", "full:www.example.org", "list:b"},
+		{"myads.net.", "keyword:ads", "list:a"},
+		{"cdn1.example.net.", `regexp:^cdn\d+\.`, "list:b"},
+	}
+	for _, tc := range tests {
+		rule, source, ok := l.Match(tc.name)
+		if !ok || rule != tc.rule || source != tc.source {
+			t.Errorf("Match(%q) = %q, %q, %v, want %q, %q", tc.name, rule, source, ok, tc.rule, tc.source)
+		}
+	}
+	if _, _, ok := l.Match("example.org."); ok {
+		t.Error("Match(\"example.org.\") matched")
+	}
+
+	counts := l.Counts()
+	if counts["list:a"] != 2 || counts["list:b"] != 2 {
+		t.Errorf("Counts() = %v", counts)
+	}
+}
+
+func TestParseDomainRuleAttributes(t *testing.T) {
+	cn := []*router.Domain_Attribute{{Key: "cn", TypedValue: &router.Domain_Attribute_BoolValue{BoolValue: true}}}
+	geosite := &router.GeoSiteList{Entry: []*router.GeoSite{{
+		CountryCode: "GOOGLE",
+		Domain: []*router.Domain{
+			{Type: router.Domain_Domain, Value: "google.cn", Attribute: cn},
+			{Type: router.Domain_Domain, Value: "google.com"},
+		},
+	}}}
+
+	tests := []struct {
+		rule string
+		want []string
+	}{
+		{"geosite:google", []string{"google.cn", "google.com"}},
+		{"geosite:google@cn", []string{"google.cn"}},
+		{"geosite:google@!cn", []string{"google.com"}},
+		{"geosite:google@cn@!cn", nil},
+	}
+	for _, tc := range tests {
+		domains, err := parseDomainRule(geosite, tc.rule)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.rule, err)
+		}
+		var got []string
+		for _, d := range domains {
+			got = append(got, d.GetValue())
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.rule, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: got %v, want %v", tc.rule, got, tc.want)
+			}
+		}
+	}
+
+	if _, err := parseDomainRule(geosite, "geosite:google@"); err == nil {
+		t.Error("expected error for empty attribute")
+	}
+}
+
+// mapDomainList is the previous fixed-array map implementation of the
+// suffix set, kept to benchmark DomainList against.
+type mapDomainList struct {
+	s map[[16]byte]struct{}
+	m map[[32]byte]struct{}
+	l map[[256]byte]struct{}
+}
+
+func newMapDomainList() *mapDomainList {
+	return &mapDomainList{
+		s: make(map[[16]byte]struct{}),
+		m: make(map[[32]byte]struct{}),
+		l: make(map[[256]byte]struct{}),
+	}
+}
+
+func (l *mapDomainList) Add(fqdn string) {
+	fqdn = dns.Fqdn(strings.ToLower(fqdn))
+	switch n := len(fqdn); {
+	case n <= 16:
+		var b [16]byte
+		copy(b[:], fqdn)
+		l.s[b] = struct{}{}
+	case n <= 32:
+		var b [32]byte
+		copy(b[:], fqdn)
+		l.m[b] = struct{}{}
+	default:
+		var b [256]byte
+		copy(b[:], fqdn)
+		l.l[b] = struct{}{}
+	}
+}
+
+func (l *mapDomainList) Has(fqdn string) bool {
+	idx := make([]int, 1, 6)
+	off := 0
+	end := false
+	for {
+		off, end = dns.NextLabel(fqdn, off)
+		if end {
+			break
+		}
+		idx = append(idx, off)
+	}
+	for i := range idx {
+		if l.has(fqdn[idx[len(idx)-1-i]:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *mapDomainList) has(fqdn string) bool {
+	switch n := len(fqdn); {
+	case n <= 16:
+		var b [16]byte
+		copy(b[:], fqdn)
+		_, ok := l.s[b]
+		return ok
+	case n <= 32:
+		var b [32]byte
+		copy(b[:], fqdn)
+		_, ok := l.m[b]
+		return ok
+	default:
+		var b [256]byte
+		copy(b[:], fqdn)
+		_, ok := l.l[b]
+		return ok
+	}
+}
+
+type suffixSet interface {
+	Add(string)
+	Has(string) bool
+}
+
+// geositeCN returns the domain rules of geosite:cn from the bundled geosite.dat.
+func geositeCN(b *testing.B) []string {
+	data, err := ioutil.ReadFile("geosite.dat")
+	if err != nil {
+		b.Skip(err)
+	}
+	geosite := new(router.GeoSiteList)
+	if err := proto.Unmarshal(data, geosite); err != nil {
+		b.Fatal(err)
+	}
+	var domains []string
+	for _, entry := range geosite.GetEntry() {
+		if entry.GetCountryCode() != "CN" {
+			continue
+		}
+		for _, d := range entry.GetDomain() {
+			if d.GetType() == router.Domain_Domain {
+				domains = append(domains, d.GetValue())
+			}
+		}
+	}
+	if len(domains) == 0 {
+		b.Skip("no geosite:cn domains in geosite.dat")
+	}
+	return domains
+}
+
+func benchmarkLoad(b *testing.B, newSet func() suffixSet) {
+	domains := geositeCN(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var heap uint64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		set := newSet()
+		for _, d := range domains {
+			set.Add(d)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(set)
+		heap += after.HeapAlloc - before.HeapAlloc
+	}
+	b.ReportMetric(float64(heap)/float64(b.N), "heap-B")
+	b.ReportMetric(float64(len(domains)), "domains")
+}
+
+func benchmarkHas(b *testing.B, set suffixSet) {
+	domains := geositeCN(b)
+	for _, d := range domains {
+		set.Add(d)
+	}
+	names := []string{
+		"www." + dns.Fqdn(domains[0]),
+		"a.b.c." + dns.Fqdn(domains[len(domains)/2]),
+		dns.Fqdn(domains[len(domains)-1]),
+		"www.example.com.",
+		"very.deep.sub.domain.of.something.not.listed.org.",
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Has(names[i%len(names)])
+	}
+}
+
+func BenchmarkDomainListLoad(b *testing.B) {
+	benchmarkLoad(b, func() suffixSet { return NewDomainList() })
+}
+
+func BenchmarkMapDomainListLoad(b *testing.B) {
+	benchmarkLoad(b, func() suffixSet { return newMapDomainList() })
+}
+
+func BenchmarkDomainListHas(b *testing.B) { benchmarkHas(b, NewDomainList()) }
+
+func BenchmarkMapDomainListHas(b *testing.B) { benchmarkHas(b, newMapDomainList()) }
+
+func TestRouteDecision(t *testing.T) {
+	rt := &route{rules: []string{"geosite:CN", "domain:example.cn"}, group: passGroup}
+	block := &route{rules: []string{"file:ads.txt"}, action: actionNXDomain}
+	b := New()
+	b.routes = []*route{block, rt}
+	rs := newRuleSet()
+	l := NewDomainList()
+	l.from("geosite:CN")
+	l.Add("baidu.com")
+	l.from("domain:example.cn")
+	l.Add("example.cn")
+	rs.lists[rt] = l
+	ads := NewDomainList()
+	ads.from("file:ads.txt")
+	ads.AddKeyword("ads")
+	rs.lists[block] = ads
+
+	tests := []struct {
+		name                    string
+		group, action, category string
+	}{
+		{"www.baidu.com.", passGroup, "route", "geosite:cn"},
+		{"a.example.cn.", passGroup, "route", "domain"},
+		{"ads.example.org.", "", "nxdomain", "file"},
+		{".", passGroup, "route", "apex"},
+		{"example.org.", forwardGroup, "route", "default"},
+	}
+	for _, tc := range tests {
+		group, action, category := b.matchName(tc.name, "", rs).labels()
+		if group != tc.group || action != tc.action || category != tc.category {
+			t.Errorf("labels for %s = %s, %s, %s, want %s, %s, %s", tc.name, group, action, category, tc.group, tc.action, tc.category)
+		}
+	}
+
+	b.publish(rs)
+	if n := testutil.ToFloat64(RuleSetSize.WithLabelValues("route", "geosite:cn")); n != 1 {
+		t.Errorf("geosite:cn has %v entries, want 1", n)
+	}
+	before := testutil.CollectAndCount(RuleSetSize)
+	b.publish(newRuleSet())
+	if removed := before - testutil.CollectAndCount(RuleSetSize); removed != 3 {
+		t.Errorf("%d rule categories removed, want 3", removed)
+	}
+}
@@ -0,0 +1,105 @@
+package bypass
+
+import (
+	"strings"
+	"time"
+)
+
+// ruleSet is an immutable snapshot of the loaded rules. A reload builds a new one off to the side
+// and publishes it with a single atomic store, queries keep the snapshot they started with.
+type ruleSet struct {
+	version  uint64
+	loaded   time.Time
+	checksum string // combined checksum of the rule files it was built from
+
+	lists   map[*route]*DomainList
+	exclude *DomainList
+	verify  *IPSet // nil when no verify set is configured
+}
+
+// newRuleSet returns an empty rule set with version 0.
+func newRuleSet() *ruleSet {
+	return &ruleSet{lists: map[*route]*DomainList{}, exclude: NewDomainList()}
+}
+
+// match returns the source of the rule of rt that name matches, e.g. geosite:cn.
+func (rs *ruleSet) match(rt *route, name string) (string, bool) {
+	l, ok := rs.lists[rt]
+	if !ok {
+		return "", false
+	}
+	return l.matchSource(name)
+}
+
+// ruleCategory returns the category of a rule source for metric labels. A geosite rule such as
+// geosite:cn is its own category, any other rule only counts by type, e.g. domain or file, so
+// there are no more categories than geosite rules in the Corefile.
+func ruleCategory(source string) string {
+	i := strings.Index(source, ":")
+	if i < 0 {
+		return "other"
+	}
+	switch typ := source[:i]; typ {
+	case "geosite":
+		return strings.ToLower(source)
+	case "domain", "full", "keyword", "regexp", "file", "dnsmasq":
+		return typ
+	}
+	return "other"
+}
+
+// routeLen returns the number of rules in all routes.
+func (rs *ruleSet) routeLen() int {
+	n := 0
+	for _, l := range rs.lists {
+		n += l.Len()
+	}
+	return n
+}
+
+// snapshot returns the active rule set.
+func (b *Bypass) snapshot() *ruleSet { return b.rules.Load().(*ruleSet) }
+
+// publish makes rs the active rule set.
+func (b *Bypass) publish(rs *ruleSet) {
+	b.rules.Store(rs)
+	RulesVersion.Set(float64(rs.version))
+	RulesLoadTime.Set(float64(rs.loaded.Unix()))
+	b.setRuleSetSize(rs)
+	log.Infof("Loaded rules version %d: %d route rules, %d exclude rules", rs.version, rs.routeLen(), rs.exclude.Len())
+}
+
+// setRuleSetSize sets RuleSetSize to the entries of rs. Categories rs doesn't have any more are
+// removed only after the others are set, so a scrape never sees the gauges empty.
+func (b *Bypass) setRuleSetSize(rs *ruleSet) {
+	sizes := map[[2]string]int{}
+	add := func(list string, l *DomainList) {
+		for source, n := range l.Counts() {
+			sizes[[2]string{list, ruleCategory(source)}] += n
+		}
+	}
+	for _, l := range rs.lists {
+		add("route", l)
+	}
+	add("exclude", rs.exclude)
+
+	for key, n := range sizes {
+		RuleSetSize.WithLabelValues(key[0], key[1]).Set(float64(n))
+	}
+	for key := range b.sizes {
+		if _, ok := sizes[key]; !ok {
+			RuleSetSize.DeleteLabelValues(key[0], key[1])
+		}
+	}
+	b.sizes = sizes
+}
+
+// countReload records the outcome of loading what, the rules or the upstreams.
+func countReload(what string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	ReloadCount.WithLabelValues(what, result).Add(1)
+	ReloadTime.WithLabelValues(what, result).SetToCurrentTime()
+}
@@ -0,0 +1,336 @@
+package bypass
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// routingSets collects the addresses in the answers per group the queries were routed to, so a
+// gateway can route the traffic to them the same way. An address is kept for the TTL of its
+// record. The sets are written to an nftables script and an ipset restore file every interval.
+type routingSets struct {
+	nftFile   string
+	nftFamily string
+	nftTable  string
+	ipsetFile string
+	interval  time.Duration
+	max       int // addresses per group
+
+	mu     sync.Mutex
+	groups map[string]map[string]time.Time // expiry by address by group
+
+	stop chan struct{}
+}
+
+func newRoutingSets() *routingSets {
+	return &routingSets{
+		nftFamily: "inet",
+		nftTable:  "bypass",
+		interval:  defaultSetInterval,
+		max:       defaultSetMax,
+		groups:    make(map[string]map[string]time.Time),
+	}
+}
+
+// parseRoutingSets parses a routing_sets property:
+//
+//	routing_sets {
+//	    nftables FILE [FAMILY TABLE]
+//	    ipset FILE
+//	    interval DURATION
+//	    max N
+//	}
+func parseRoutingSets(c *caddyfile.Dispenser) (*routingSets, error) {
+	s := newRoutingSets()
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	if c.Val() != "{" {
+		return nil, c.SyntaxErr("{")
+	}
+	for c.Next() {
+		switch c.Val() {
+		case "}":
+			return s, nil
+		case "nftables":
+			args := c.RemainingArgs()
+			if len(args) != 1 && len(args) != 3 {
+				return nil, c.ArgErr()
+			}
+			s.nftFile = args[0]
+			if len(args) == 3 {
+				s.nftFamily, s.nftTable = args[1], args[2]
+			}
+		case "ipset":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			s.ipsetFile = c.Val()
+		case "interval":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			dur, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, err
+			}
+			if dur <= 0 {
+				return nil, c.Errf("interval must be positive: %s", dur)
+			}
+			s.interval = dur
+		case "max":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil {
+				return nil, err
+			}
+			if n <= 0 {
+				return nil, c.Errf("max must be positive: %d", n)
+			}
+			s.max = n
+		default:
+			return nil, c.Errf("unknown routing_sets property '%s'", c.Val())
+		}
+	}
+	return nil, c.EOFErr()
+}
+
+// add records the addresses in the answer of m for group.
+func (s *routingSets) add(group string, m *dns.Msg) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set := s.groups[group]
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if set == nil {
+			set = make(map[string]time.Time)
+			s.groups[group] = set
+		}
+		key := ip.String()
+		expire := now.Add(time.Duration(rr.Header().Ttl) * time.Second)
+		if old, ok := set[key]; ok {
+			if expire.After(old) {
+				set[key] = expire
+			}
+			continue
+		}
+		if len(set) >= s.max {
+			s.expire(set, now)
+			if len(set) >= s.max {
+				RoutingSetDropCount.WithLabelValues(group).Add(1)
+				continue
+			}
+		}
+		set[key] = expire
+	}
+}
+
+// expire removes the addresses whose TTL ran out from set. s.mu must be held.
+func (s *routingSets) expire(set map[string]time.Time, now time.Time) {
+	for ip, t := range set {
+		if !t.After(now) {
+			delete(set, ip)
+		}
+	}
+}
+
+// setEntry is an address with the seconds it is still valid.
+type setEntry struct {
+	IP  string `json:"ip"`
+	TTL int    `json:"ttl"`
+}
+
+// snapshot removes the expired addresses and returns the others, sorted, per group and family.
+func (s *routingSets) snapshot() map[string]map[string][]setEntry {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := make(map[string]map[string][]setEntry, len(s.groups))
+	for group, set := range s.groups {
+		s.expire(set, now)
+		RoutingSetSize.WithLabelValues(group).Set(float64(len(set)))
+		fams := map[string][]setEntry{"v4": {}, "v6": {}}
+		for ip, t := range set {
+			fam := "v6"
+			if net.ParseIP(ip).To4() != nil {
+				fam = "v4"
+			}
+			// Round up, an address must not expire before its record does.
+			ttl := int((t.Sub(now) + time.Second - 1) / time.Second)
+			fams[fam] = append(fams[fam], setEntry{IP: ip, TTL: ttl})
+		}
+		for _, entries := range fams {
+			sort.Slice(entries, func(i, j int) bool { return entries[i].IP < entries[j].IP })
+		}
+		snap[group] = fams
+	}
+	return snap
+}
+
+// flush writes the sets to the configured files.
+func (s *routingSets) flush() error {
+	snap := s.snapshot()
+	groups := make([]string, 0, len(snap))
+	for group := range snap {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	if s.nftFile != "" {
+		if err := writeFileAtomic(s.nftFile, func(w io.Writer) { s.writeNftables(w, groups, snap) }); err != nil {
+			return err
+		}
+	}
+	if s.ipsetFile != "" {
+		if err := writeFileAtomic(s.ipsetFile, func(w io.Writer) { s.writeIPSet(w, groups, snap) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNftables writes an nft -f script that replaces the elements of the sets GROUP_v4 and GROUP_v6.
+func (s *routingSets) writeNftables(w io.Writer, groups []string, snap map[string]map[string][]setEntry) {
+	table := s.nftFamily + " " + s.nftTable
+	fmt.Fprintf(w, "add table %s\n", table)
+	for _, group := range groups {
+		for _, fam := range []string{"v4", "v6"} {
+			name := group + "_" + fam
+			typ := "ipv4_addr"
+			if fam == "v6" {
+				typ = "ipv6_addr"
+			}
+			fmt.Fprintf(w, "add set %s %s { type %s; flags timeout; }\n", table, name, typ)
+			fmt.Fprintf(w, "flush set %s %s\n", table, name)
+			entries := snap[group][fam]
+			if len(entries) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "add element %s %s {", table, name)
+			for i, e := range entries {
+				if i > 0 {
+					io.WriteString(w, ",")
+				}
+				fmt.Fprintf(w, " %s timeout %ds", e.IP, e.TTL)
+			}
+			io.WriteString(w, " }\n")
+		}
+	}
+}
+
+// writeIPSet writes an ipset restore file that replaces the entries of the sets bypass_GROUP_v4 and
+// bypass_GROUP_v6.
+func (s *routingSets) writeIPSet(w io.Writer, groups []string, snap map[string]map[string][]setEntry) {
+	for _, group := range groups {
+		for _, fam := range []string{"v4", "v6"} {
+			name := ipsetName(group, fam)
+			family := "inet"
+			if fam == "v6" {
+				family = "inet6"
+			}
+			fmt.Fprintf(w, "create %s hash:ip family %s timeout 0 maxelem %d -exist\n", name, family, s.max)
+			fmt.Fprintf(w, "flush %s\n", name)
+			for _, e := range snap[group][fam] {
+				fmt.Fprintf(w, "add %s %s timeout %d -exist\n", name, e.IP, e.TTL)
+			}
+		}
+	}
+}
+
+// ipsetMaxName is the longest set name ipset accepts.
+const ipsetMaxName = 31
+
+// ipsetName returns the name of the ipset set of group for the family fam, v4 or v6.
+func ipsetName(group, fam string) string { return "bypass_" + group + "_" + fam }
+
+// check returns an error if the sets of one of groups can't be written, as their names are too long
+// for ipset.
+func (s *routingSets) check(groups map[string]*Group) error {
+	if s.ipsetFile == "" {
+		return nil
+	}
+	for group := range groups {
+		if name := ipsetName(group, "v4"); len(name) > ipsetMaxName {
+			return fmt.Errorf("ipset set %s of group %s is longer than %d characters", name, group, ipsetMaxName)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file at path with write and renames it into place, so readers never see
+// a partial file.
+func writeFileAtomic(path string, write func(io.Writer)) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	write(bw)
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// start writes the sets every interval until stopped.
+func (s *routingSets) start() {
+	s.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.flush(); err != nil {
+					log.Warningf("Failed to write routing sets: %s", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *routingSets) close() {
+	if s.stop != nil {
+		close(s.stop)
+	}
+}
+
+const (
+	defaultSetInterval = 10 * time.Second
+	defaultSetMax      = 65536
+)
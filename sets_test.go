@@ -0,0 +1,135 @@
+package bypass
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestRoutingSets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newRoutingSets()
+	s.nftFile, s.ipsetFile, s.max = filepath.Join(dir, "sets.nft"), filepath.Join(dir, "sets.ipset"), 2
+
+	answer := func(rrs ...string) *dns.Msg {
+		m := new(dns.Msg)
+		for _, rr := range rrs {
+			r, err := dns.NewRR(rr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Answer = append(m.Answer, r)
+		}
+		return m
+	}
+	s.add(passGroup, answer("example.cn. 300 IN CNAME cdn.example.cn.", "cdn.example.cn. 60 IN A 192.0.2.1", "cdn.example.cn. 0 IN A 192.0.2.2"))
+	s.add(passGroup, answer("example.cn. 600 IN A 192.0.2.1", "example.cn. 600 IN A 192.0.2.3", "example.cn. 600 IN A 192.0.2.4"))
+	s.add(forwardGroup, answer("example.com. 120 IN AAAA 2001:db8::1"))
+
+	snap := s.snapshot()
+	pass := snap[passGroup]["v4"]
+	// 192.0.2.2 expired right away, which left room for 192.0.2.3 but not for 192.0.2.4.
+	if len(pass) != 2 || pass[0].IP != "192.0.2.1" || pass[0].TTL != 600 || pass[1].IP != "192.0.2.3" {
+		t.Errorf("got pass set %v", pass)
+	}
+	if fwd := snap[forwardGroup]["v6"]; len(fwd) != 1 || fwd[0].IP != "2001:db8::1" {
+		t.Errorf("got forward set %v", fwd)
+	}
+
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	nft, _ := ioutil.ReadFile(s.nftFile)
+	for _, want := range []string{
+		"add set inet bypass pass_v4 { type ipv4_addr; flags timeout; }\nflush set inet bypass pass_v4\n",
+		"add element inet bypass pass_v4 { 192.0.2.1 timeout 600s, 192.0.2.3 timeout 600s }\n",
+		"add element inet bypass forward_v6 { 2001:db8::1 timeout 120s }\n",
+	} {
+		if !strings.Contains(string(nft), want) {
+			t.Errorf("nftables file lacks %q:\n%s", want, nft)
+		}
+	}
+	ipset, _ := ioutil.ReadFile(s.ipsetFile)
+	for _, want := range []string{
+		"create bypass_forward_v6 hash:ip family inet6 timeout 0 maxelem 2 -exist\nflush bypass_forward_v6\nadd bypass_forward_v6 2001:db8::1 timeout 120 -exist\n",
+		"add bypass_pass_v4 192.0.2.3 timeout 600 -exist\n",
+	} {
+		if !strings.Contains(string(ipset), want) {
+			t.Errorf("ipset file lacks %q:\n%s", want, ipset)
+		}
+	}
+}
+
+func TestRoutingSetsAnsweringGroup(t *testing.T) {
+	pass, fwd := udpServer(t, "192.0.2.1"), udpServer(t, "198.51.100.1")
+	cfg, err := parseUpstreams("pass " + pass + "\nforward " + fwd + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New()
+	up := cfg.build(nil)
+	b.up.Store(up)
+	for _, p := range up.proxies {
+		p.start(hcInterval)
+		defer p.close()
+	}
+	rs := newRuleSet()
+	if rs.verify, err = parseIPList([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	b.publish(rs)
+	b.sets = newRoutingSets()
+
+	// The name matches no route, but pass answers it with a domestic address.
+	for _, race := range []bool{false, true} {
+		b.race = race
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		if _, err := b.ServeDNS(context.Background(), &test.ResponseWriter{}, m); err != nil {
+			t.Fatal(err)
+		}
+		snap := b.sets.snapshot()
+		if len(snap[passGroup]["v4"]) != 1 || len(snap[forwardGroup]["v4"]) != 0 {
+			t.Errorf("race %v: got sets %v", race, snap)
+		}
+	}
+}
+
+func TestRoutingSetsGroupNameLength(t *testing.T) {
+	corefile := func(group, sets string) string {
+		return `bypass . 127.0.0.1:5301 {
+    forward 127.0.0.1:5302
+    group ` + group + ` 127.0.0.1:5303
+    routing_sets {
+        ` + sets + `
+    }
+}`
+	}
+	long, fits := strings.Repeat("g", 22), strings.Repeat("g", 21) // bypass_GROUP_v4 has at most 31 characters
+	tests := []struct {
+		group, sets string
+		err         bool
+	}{
+		{fits, "ipset /tmp/bypass.ipset", false},
+		{long, "ipset /tmp/bypass.ipset", true},
+		{long, "nftables /tmp/bypass.nft", false},
+	}
+	for _, tc := range tests {
+		_, err := parseBypass(caddy.NewTestController("dns", corefile(tc.group, tc.sets)))
+		if (err != nil) != tc.err {
+			t.Errorf("group %s with %s: got error %v", tc.group, tc.sets, err)
+		}
+	}
+}
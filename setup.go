@@ -2,23 +2,20 @@ package bypass
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyfile"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
-	"github.com/coredns/coredns/plugin/pkg/parse"
 	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
-	"github.com/coredns/coredns/plugin/pkg/transport"
 )
 
-var once sync.Once
-
 func init() {
 	caddy.RegisterPlugin("bypass", caddy.Plugin{
 		ServerType: "dns",
@@ -31,13 +28,6 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return plugin.Error("bypass", err)
 	}
-	if b.LenPass() > max {
-		return plugin.Error("bypass", fmt.Errorf("more than %d TOs configured: %d", max, b.LenPass()))
-	}
-
-	if b.LenForward() > max {
-		return plugin.Error("bypass", fmt.Errorf("more than %d TOs configured: %d", max, b.LenForward()))
-	}
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		b.Next = next
 		return b
@@ -50,34 +40,36 @@ func setup(c *caddy.Controller) error {
 	c.OnShutdown(func() error {
 		return b.OnShutdown()
 	})
-	once.Do(func() {
-		caddy.RegisterEventHook("reloadg", b.hook)
-	})
-
 	return nil
 }
 
-// OnStartup starts a goroutines for all proxies.
+// OnStartup starts a goroutines for all proxies and the reloading of rules and upstreams.
 func (b *Bypass) OnStartup() (err error) {
-	for _, p := range b.forward {
+	for _, p := range b.upstream().proxies {
 		p.start(b.hcInterval)
 	}
-	for _, p := range b.pass {
-		p.start(b.hcInterval)
-
+	if b.sets != nil {
+		b.sets.start()
+	}
+	b.watch()
+	if b.admin != nil {
+		return b.admin.startup()
 	}
 	return nil
 }
 
-// OnShutdown stops all configured proxies.
+// OnShutdown stops all configured proxies and the reloading.
 func (b *Bypass) OnShutdown() error {
-	for _, p := range b.forward {
+	for _, p := range b.upstream().proxies {
 		p.close()
 	}
-	for _, p := range b.pass {
-		p.close()
+	if b.admin != nil {
+		b.admin.shutdown()
 	}
-	b.quit <- true
+	if b.sets != nil {
+		b.sets.close()
+	}
+	close(b.quit)
 
 	return nil
 }
@@ -118,42 +110,21 @@ func ParseBypassStanza(c *caddyfile.Dispenser) (*Bypass, error) {
 		return b, c.ArgErr()
 	}
 
-	toHosts, err := parse.HostPortOrFile(to...)
-	if err != nil {
+	if err := b.cfg.groups[passGroup].add(to...); err != nil {
 		return b, err
 	}
 
-	transports := make([]string, len(toHosts))
-	for i, host := range toHosts {
-		trans, h := parse.Transport(host)
-		p := NewProxy(h, trans)
-		b.pass = append(b.pass, p)
-		transports[i] = trans
-	}
-
 	for c.NextBlock() {
 		if err := parseBlock(c, b); err != nil {
 			return b, err
 		}
 	}
 
-	if b.tlsServerName != "" {
-		b.tlsConfig.ServerName = b.tlsServerName
-	}
-	for i := range b.pass {
-		// Only set this for proxies that need it.
-		if transports[i] == transport.TLS {
-			b.pass[i].SetTLSConfig(b.tlsConfig)
-		}
-		b.pass[i].SetExpire(b.expire)
+	if _, _, err := b.loadUpstreams(false); err != nil {
+		return b, err
 	}
-	for i := range b.forward {
-		// Only set this for proxies that need it.
-		if transports[i] == transport.TLS {
-			b.forward[i].SetTLSConfig(b.tlsConfig)
-		}
-		b.forward[i].SetExpire(b.expire)
-
+	if err := b.loadRules(); err != nil {
+		return b, err
 	}
 	return b, nil
 }
@@ -174,56 +145,85 @@ func parseBlock(c *caddyfile.Dispenser, b *Bypass) error {
 			return err
 		}
 		b.geosite = path
-	case "include":
-		if !c.NextArg() {
-			return c.ArgErr()
-		}
-		domain := c.Val()
-		domains := strings.Split(domain, ",")
-		file, err := os.Open(b.geosite)
+	case "include", "route", "block":
+		rt, err := parseRoute(c)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		fileinfo, err := file.Stat()
-		if err != nil {
-			return err
+		b.routes = append(b.routes, rt)
+	case "default":
+		if !c.NextArg() {
+			return c.ArgErr()
 		}
-		csum, err := PartialChecksum(file, fileinfo.Size())
-		if err != nil {
-			return err
+		b.def = c.Val()
+	case "client":
+		return parseClient(c, b)
+	case "exclude":
+		if !c.NextArg() {
+			return c.ArgErr()
 		}
-		b.domainChecksum = string(csum)
-		b.domains = domains
-		include, err := loadGeoSiteData(b.geosite, b.domains)
-		if err != nil {
+		b.excludes = strings.Split(c.Val(), ",")
+	case "geoip":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		path := c.Val()
+		if _, err := os.Stat(path); err != nil {
 			return err
 		}
-		b.include = include
-	case "forward":
-		forward := c.RemainingArgs()
-		if len(forward) == 0 {
+		b.geoip = path
+	case "verify":
+		if !c.NextArg() {
 			return c.ArgErr()
 		}
-		transports := make([]string, len(forward))
-		for i, host := range forward {
-			trans, h := parse.Transport(host)
-			p := NewProxy(h, trans)
-			b.forward = append(b.forward, p)
-			transports[i] = trans
+		b.verify = strings.Split(c.Val(), ",")
+	case "race":
+		args := c.RemainingArgs()
+		if len(args) > 2 {
+			return c.ArgErr()
 		}
-	case "max_fails":
+		timeouts := []*time.Duration{&b.passTimeout, &b.forwardTimeout}
+		for i, arg := range args {
+			dur, err := time.ParseDuration(arg)
+			if err != nil {
+				return err
+			}
+			if dur <= 0 {
+				return fmt.Errorf("race timeout must be positive: %s", dur)
+			}
+			*timeouts[i] = dur
+		}
+		b.race = true
+	case "pass", "forward", "group", "policy", "fallback", "max_fails", "tls", "tls_servername", "expire", "doh_method", "force_tcp", "prefer_udp", "anti_poison":
+		return parseUpstream(c, b.cfg)
+	case "upstreams":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
-		n, err := strconv.Atoi(c.Val())
-		if err != nil {
+		path := c.Val()
+		if _, err := os.Stat(path); err != nil {
 			return err
 		}
-		if n < 0 {
-			return fmt.Errorf("max_fails can't be negative: %d", n)
+		b.upstreamFile = path
+	case "admin":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		addr := defaultAdminAddr
+		if len(args) == 1 {
+			addr = args[0]
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
 		}
-		b.maxfails = uint32(n)
+		b.admin = &admin{addr: addr, b: b}
+	case "routing_sets":
+		sets, err := parseRoutingSets(c)
+		if err != nil {
+			return err
+		}
+		b.sets = sets
 	case "health_check":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -236,16 +236,109 @@ func parseBlock(c *caddyfile.Dispenser, b *Bypass) error {
 			return fmt.Errorf("health_check can't be negative: %d", dur)
 		}
 		b.hcInterval = dur
-	case "force_tcp":
-		if c.NextArg() {
+	case "reload":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
 			return c.ArgErr()
 		}
-		b.opts.forceTCP = true
-	case "prefer_udp":
-		if c.NextArg() {
+		dur, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("reload duration can't be negative: %s", dur)
+		}
+		b.dur = dur
+		if len(args) == 2 {
+			debounce, err := time.ParseDuration(args[1])
+			if err != nil {
+				return err
+			}
+			if debounce < 0 {
+				return fmt.Errorf("reload debounce can't be negative: %s", debounce)
+			}
+			b.debounce = debounce
+		}
+
+	default:
+		return c.Errf("unknown property '%s'", c.Val())
+	}
+
+	return nil
+}
+
+// parseUpstream parses an upstream property into cfg. These may also be given in an upstream file.
+func parseUpstream(c *caddyfile.Dispenser, cfg *upstreamConfig) error {
+	switch c.Val() {
+	case "pass", "forward":
+		name := passGroup
+		if c.Val() == "forward" {
+			name = forwardGroup
+		}
+		to := c.RemainingArgs()
+		if len(to) == 0 {
 			return c.ArgErr()
 		}
-		b.opts.preferUDP = true
+		if err := cfg.group(name).add(to...); err != nil {
+			return err
+		}
+	case "group":
+		return parseGroup(c, cfg)
+	case "policy":
+		p, err := parsePolicy(c)
+		if err != nil {
+			return err
+		}
+		cfg.p = p
+	case "fallback":
+		return parseFallback(c, cfg)
+	case "max_fails", "tls", "tls_servername", "expire", "doh_method", "force_tcp", "prefer_udp", "anti_poison":
+		return parseUpstreamOption(c, &cfg.upstreamOptions)
+	default:
+		return c.Errf("unknown upstream property '%s'", c.Val())
+	}
+	return nil
+}
+
+// parseFallback parses a chain of groups, each asked when every upstream of the one before it failed:
+//
+//	fallback pass -> forward [-> GROUP...]
+func parseFallback(c *caddyfile.Dispenser, cfg *upstreamConfig) error {
+	args := c.RemainingArgs()
+	if len(args) < 3 || len(args)%2 == 0 {
+		return c.ArgErr()
+	}
+	for i := 1; i < len(args); i += 2 {
+		if args[i] != "->" {
+			return c.Errf("expected '->' between groups, got '%s'", args[i])
+		}
+	}
+	for i := 0; i+2 < len(args); i += 2 {
+		from, to := args[i], args[i+2]
+		if prev, ok := cfg.fallbacks[from]; ok && prev != to {
+			return c.Errf("group '%s' already falls back to '%s'", from, prev)
+		}
+		cfg.fallbacks[from] = to
+	}
+	return nil
+}
+
+// parseUpstreamOption parses a property of the proxies of a group, or of all groups, into o.
+func parseUpstreamOption(c *caddyfile.Dispenser, o *upstreamOptions) error {
+	name := c.Val()
+	switch name {
+	case "max_fails":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("max_fails can't be negative: %d", n)
+		}
+		o.maxfails = uint32(n)
 	case "tls":
 		args := c.RemainingArgs()
 		if len(args) > 3 {
@@ -256,12 +349,13 @@ func parseBlock(c *caddyfile.Dispenser, b *Bypass) error {
 		if err != nil {
 			return err
 		}
-		b.tlsConfig = tlsConfig
+		o.tlsArgs = args
+		o.tlsConfig = tlsConfig
 	case "tls_servername":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
-		b.tlsServerName = c.Val()
+		o.tlsServerName = c.Val()
 	case "expire":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -273,39 +367,175 @@ func parseBlock(c *caddyfile.Dispenser, b *Bypass) error {
 		if dur < 0 {
 			return fmt.Errorf("expire can't be negative: %s", dur)
 		}
-		b.expire = dur
-	case "policy":
+		o.expire = dur
+	case "doh_method":
 		if !c.NextArg() {
 			return c.ArgErr()
 		}
-		switch x := c.Val(); x {
-		case "random":
-			b.p = &random{}
-		case "round_robin":
-			b.p = &roundRobin{}
-		case "sequential":
-			b.p = &sequential{}
-		default:
-			return c.Errf("unknown policy '%s'", x)
+		method := strings.ToUpper(c.Val())
+		if method != http.MethodGet && method != http.MethodPost {
+			return c.Errf("unknown doh_method '%s'", c.Val())
 		}
-	case "reload":
-		if !c.NextArg() {
+		o.dohMethod = method
+	case "force_tcp":
+		if c.NextArg() {
 			return c.ArgErr()
 		}
-		dur, err := time.ParseDuration(c.Val())
+		o.opts.forceTCP = true
+	case "prefer_udp":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		o.opts.preferUDP = true
+	case "anti_poison":
+		ap, err := parseAntiPoison(c)
 		if err != nil {
 			return err
 		}
-		if dur < 0 {
-			return fmt.Errorf("reload duration can't be negative: %s", dur)
+		o.opts.poison = ap
+	default:
+		return c.Errf("unknown upstream property '%s'", name)
+	}
+	if o.set == nil {
+		o.set = make(map[string]bool)
+	}
+	o.set[name] = true
+	return nil
+}
+
+// parseGroup parses a named upstream group:
+//
+//	group NAME [TO...] {
+//	    to TO...
+//	    policy random|round_robin|sequential
+//	    ecs pass|strip|add CIDR|add client [V4LEN [V6LEN]]
+//	    proxy socks5|http://[USER:PASSWORD@]HOST:PORT
+//	    bogus_ip nxdomain|retry|GROUP IP|CIDR|FILE...
+//	    max_fails|tls|tls_servername|expire|doh_method|force_tcp|prefer_udp|anti_poison ...
+//	}
+//
+// The pass and forward groups can be given properties the same way. The proxy properties override
+// those given outside of a group.
+func parseGroup(c *caddyfile.Dispenser, cfg *upstreamConfig) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	name := c.Val()
+	g := cfg.group(name)
+	if g.declared {
+		return c.Errf("group '%s' already defined", name)
+	}
+	g.declared = true
+	if to := c.RemainingArgs(); len(to) > 0 {
+		if err := g.add(to...); err != nil {
+			return err
 		}
-		b.dur = dur
+	}
+	if !c.NextArg() {
+		return nil
+	}
+	if c.Val() != "{" {
+		return c.SyntaxErr("{")
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		switch c.Val() {
+		case "to":
+			to := c.RemainingArgs()
+			if len(to) == 0 {
+				return c.ArgErr()
+			}
+			if err := g.add(to...); err != nil {
+				return err
+			}
+		case "policy":
+			p, err := parsePolicy(c)
+			if err != nil {
+				return err
+			}
+			g.p = p
+		case "ecs":
+			ecs, err := parseECS(c)
+			if err != nil {
+				return err
+			}
+			g.ecs = ecs
+		case "proxy":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			via, err := parseDialProxy(c.Val())
+			if err != nil {
+				return c.Errf("%s", err)
+			}
+			g.via = via
+		case "bogus_ip":
+			f, err := parseBogusIP(c)
+			if err != nil {
+				return err
+			}
+			g.bogus = f
+		case "max_fails", "tls", "tls_servername", "expire", "doh_method", "force_tcp", "prefer_udp", "anti_poison":
+			if err := parseUpstreamOption(c, &g.upstreamOptions); err != nil {
+				return err
+			}
+		default:
+			return c.Errf("unknown group property '%s'", c.Val())
+		}
+	}
+	return c.EOFErr()
+}
 
-	default:
-		return c.Errf("unknown property '%s'", c.Val())
+// parseRoute parses an include, route or block property.
+func parseRoute(c *caddyfile.Dispenser) (*route, error) {
+	switch c.Val() {
+	case "include":
+		if !c.NextArg() {
+			return nil, c.ArgErr()
+		}
+		return &route{rules: strings.Split(c.Val(), ","), group: passGroup}, nil
+	case "route":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return nil, c.ArgErr()
+		}
+		return &route{rules: strings.Split(args[0], ","), group: args[1]}, nil
 	}
 
-	return nil
+	// block
+	args := c.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return nil, c.ArgErr()
+	}
+	a := actionNXDomain
+	if len(args) == 2 {
+		var ok bool
+		if a, ok = actions[args[1]]; !ok || a == actionRoute {
+			return nil, c.Errf("unknown block action '%s'", args[1])
+		}
+	}
+	return &route{rules: strings.Split(args[0], ","), action: a}, nil
+}
+
+// parsePolicy parses the argument of a policy property.
+func parsePolicy(c *caddyfile.Dispenser) (Policy, error) {
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	switch x := c.Val(); x {
+	case "random":
+		return &random{}, nil
+	case "round_robin":
+		return &roundRobin{}, nil
+	case "sequential":
+		return &sequential{}, nil
+	default:
+		return nil, c.Errf("unknown policy '%s'", x)
+	}
 }
 
 const max = 15 // Maximum number of upstreams.
+
+const defaultAdminAddr = "localhost:8054"
@@ -0,0 +1,163 @@
+package bypass
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestParseGroupsAndRoutes(t *testing.T) {
+	c := caddy.NewTestController("dns", `bypass . 127.0.0.1:5301 {
+    group domestic 127.0.0.1:5302 {
+        policy sequential
+    }
+    group oversea {
+        to 127.0.0.1:5303 127.0.0.1:5304
+    }
+    route domain:example.cn,domain:example.com.cn domestic
+    route full:www.example.org oversea
+    block domain:ads.example.com
+    default oversea
+}`)
+	b, err := parseBypass(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := b.upstream()
+	for name, n := range map[string]int{passGroup: 1, "domestic": 1, "oversea": 2} {
+		if g, ok := up.groups[name]; !ok || g.Len() != n {
+			t.Errorf("group %s: got %v", name, g)
+		}
+	}
+	if _, ok := up.groups["domestic"].p.(*sequential); !ok {
+		t.Errorf("domestic policy: got %T", up.groups["domestic"].p)
+	}
+	if b.def != "oversea" {
+		t.Errorf("default: got %s", b.def)
+	}
+	want := []route{
+		{rules: []string{"domain:example.cn", "domain:example.com.cn"}, group: "domestic"},
+		{rules: []string{"full:www.example.org"}, group: "oversea"},
+		{rules: []string{"domain:ads.example.com"}, action: actionNXDomain},
+	}
+	if len(b.routes) != len(want) {
+		t.Fatalf("got %d routes, want %d", len(b.routes), len(want))
+	}
+	for i, rt := range b.routes {
+		if !reflect.DeepEqual(*rt, want[i]) {
+			t.Errorf("route %d: got %+v, want %+v", i, *rt, want[i])
+		}
+	}
+}
+
+func TestParseForwardSugar(t *testing.T) {
+	// include and forward are the older syntax for a route to pass and the forward group.
+	c := caddy.NewTestController("dns", `bypass . 127.0.0.1:5301 {
+    include domain:example.cn
+    forward 127.0.0.1:5302 127.0.0.1:5303
+}`)
+	b, err := parseBypass(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := b.upstream()
+	if g := up.groups[forwardGroup]; g == nil || g.Len() != 2 {
+		t.Errorf("forward group: got %v", g)
+	}
+	if g := up.groups[passGroup]; g == nil || g.Len() != 1 {
+		t.Errorf("pass group: got %v", g)
+	}
+	if b.def != forwardGroup {
+		t.Errorf("default: got %s", b.def)
+	}
+	if len(b.routes) != 1 || b.routes[0].group != passGroup || !reflect.DeepEqual(b.routes[0].rules, []string{"domain:example.cn"}) {
+		t.Errorf("include: got %+v", b.routes)
+	}
+}
+
+func TestParseGroupsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"unknown route group", `bypass . 127.0.0.1:5301 {
+    forward 127.0.0.1:5302
+    route domain:example.cn nowhere
+}`},
+		{"unknown default", `bypass . 127.0.0.1:5301 {
+    forward 127.0.0.1:5302
+    default nowhere
+}`},
+		{"group twice", `bypass . 127.0.0.1:5301 {
+    group domestic 127.0.0.1:5302
+    group domestic 127.0.0.1:5303
+}`},
+		{"route without group", `bypass . 127.0.0.1:5301 {
+    route domain:example.cn
+}`},
+		{"unknown group property", `bypass . 127.0.0.1:5301 {
+    group domestic 127.0.0.1:5302 {
+        weight 2
+    }
+}`},
+	}
+	for _, tc := range tests {
+		if _, err := parseBypass(caddy.NewTestController("dns", tc.input)); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
+
+func TestRestartWatchesNewInstance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bypass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list.txt")
+	if err := ioutil.WriteFile(path, []byte("a.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	corefile := `bypass . 127.0.0.1:5301 {
+    include file:` + path + `
+    forward 127.0.0.1:5302
+    reload 1h 10ms
+}`
+
+	// A Corefile reload shuts the old instance down and starts a new one, several times over.
+	var b *Bypass
+	for i := 0; i < 3; i++ {
+		if b, err = parseBypass(caddy.NewTestController("dns", corefile)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.OnStartup(); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			break
+		}
+		done := make(chan struct{})
+		go func() { b.OnShutdown(); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("shutdown %d hangs", i)
+		}
+	}
+	defer b.OnShutdown()
+
+	if err := ioutil.WriteFile(path, []byte("a.example\nb.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && b.snapshot().version < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if v := b.snapshot().version; v != 2 {
+		t.Errorf("running instance didn't reload, version %d", v)
+	}
+}
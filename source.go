@@ -0,0 +1,133 @@
+package bypass
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"v2ray.com/core/app/router"
+)
+
+// ruleFile returns the path of the text list a rule refers to, if any.
+func ruleFile(rule string) (string, bool) {
+	switch {
+	case strings.HasPrefix(rule, "file:"):
+		return rule[5:], true
+	case strings.HasPrefix(rule, "dnsmasq:"):
+		return rule[8:], true
+	}
+	return "", false
+}
+
+// loadDomainFile reads a domain-per-line list. Lines may carry a domain:,
+// full:, keyword: or regexp: prefix, bare names are treated as domain:.
+// A # at the start of a line or after a space starts a comment, empty lines
+// are skipped.
+func loadDomainFile(path string) ([]*router.Domain, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var domains []*router.Domain
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		d, err := parseTextRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		domains = append(domains, d)
+	}
+	return domains, scanner.Err()
+}
+
+// loadDnsmasqFile reads the domains from dnsmasq server lines, such as
+// server=/example.cn/114.114.114.114. All other lines are ignored.
+func loadDnsmasqFile(path string) ([]*router.Domain, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var domains []*router.Domain
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "server=/") {
+			continue
+		}
+		// server=/a.cn/b.cn/114.114.114.114: everything between the first
+		// and the last slash is a domain.
+		fields := strings.Split(line[len("server="):], "/")
+		if len(fields) < 3 {
+			continue
+		}
+		for _, name := range fields[1 : len(fields)-1] {
+			if name == "" {
+				continue
+			}
+			domains = append(domains, &router.Domain{Type: router.Domain_Domain, Value: name})
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// stripComment returns line without a comment, which starts with a # at the
+// beginning of the line or after a space. A # within a rule, as in a regexp,
+// is kept.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseTextRule parses a single rule from a text list.
+func parseTextRule(line string) (*router.Domain, error) {
+	d := &router.Domain{Type: router.Domain_Domain, Value: line}
+	if i := strings.Index(line, ":"); i > 0 {
+		switch line[:i] {
+		case "domain":
+			d.Type = router.Domain_Domain
+		case "full":
+			d.Type = router.Domain_Full
+		case "keyword":
+			d.Type = router.Domain_Plain
+		case "regexp":
+			d.Type = router.Domain_Regex
+		default:
+			return nil, fmt.Errorf("unknown rule type %q", line[:i])
+		}
+		d.Value = line[i+1:]
+	}
+	if d.Value == "" {
+		return nil, fmt.Errorf("empty rule %q", line)
+	}
+	if strings.ContainsAny(d.Value, " \t") {
+		return nil, fmt.Errorf("whitespace in rule %q", line)
+	}
+	return d, nil
+}
+
+// FormatRule returns d as a rule of a text list, e.g. domain:example.com.
+func FormatRule(d *router.Domain) string {
+	switch d.GetType() {
+	case router.Domain_Full:
+		return "full:" + d.GetValue()
+	case router.Domain_Plain:
+		return "keyword:" + d.GetValue()
+	case router.Domain_Regex:
+		return "regexp:" + d.GetValue()
+	default:
+		return "domain:" + d.GetValue()
+	}
+}
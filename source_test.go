@@ -0,0 +1,89 @@
+package bypass
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"v2ray.com/core/app/router"
+)
+
+func TestLoadTextLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		load    func(string) ([]*router.Domain, error)
+		content string
+		want    []string
+		err     string // part of the expected error, "" if none
+	}{
+		{
+			name: "domain file",
+			load: loadDomainFile,
+			content: `# comment
+example.com
+  domain:example.org  # cdn
+
+full:www.example.net
+keyword:ads	# tab before the comment
+regexp:^cdn\d+\.
+regexp:^a#b\.
+`,
+			want: []string{"domain:example.com", "domain:example.org", "full:www.example.net", "keyword:ads", `regexp:^cdn\d+\.`, `regexp:^a#b\.`},
+		},
+		{name: "hosts line", load: loadDomainFile, content: "example.com\n0.0.0.0 example.org\n", err: ":2: whitespace in rule"},
+		{name: "unknown type", load: loadDomainFile, content: "example.com\nhost:example.org\n", err: ":2: unknown rule type"},
+		{name: "empty rule", load: loadDomainFile, content: "full:\n", err: ":1: empty rule"},
+		{name: "empty domain file", load: loadDomainFile, content: "# nothing\n\n"},
+		{
+			name: "dnsmasq file",
+			load: loadDnsmasqFile,
+			content: `# comment
+server=/example.cn/114.114.114.114
+server=/a.cn/b.cn/223.5.5.5#53
+  server=/c.cn/119.29.29.29
+server=//1.1.1.1
+server=/d.cn
+address=/e.cn/127.0.0.1
+ipset=/f.cn/cn
+`,
+			want: []string{"domain:example.cn", "domain:a.cn", "domain:b.cn", "domain:c.cn"},
+		},
+	}
+	for _, tc := range tests {
+		path := filepath.Join(dir, strings.Replace(tc.name, " ", "_", -1))
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		domains, err := tc.load(path)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got error %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		var got []string
+		for _, d := range domains {
+			got = append(got, FormatRule(d))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := loadDomainFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
@@ -0,0 +1,387 @@
+package bypass
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// upstreamConfig holds the upstream properties: the groups and the options their proxies use unless
+// a group sets its own.
+type upstreamConfig struct {
+	groups    map[string]*Group
+	p         Policy
+	fallbacks map[string]string // the group to ask when every upstream of a group failed, by group
+	upstreamOptions
+
+	// fresh is non-nil while an upstream file is applied and records the groups it mentioned.
+	fresh map[string]bool
+}
+
+func newUpstreamConfig() *upstreamConfig {
+	return &upstreamConfig{
+		groups:    map[string]*Group{passGroup: NewGroup(passGroup)},
+		p:         new(random),
+		fallbacks: make(map[string]string),
+		upstreamOptions: upstreamOptions{
+			maxfails:  2,
+			tlsConfig: new(tls.Config),
+			expire:    defaultExpire,
+			dohMethod: http.MethodPost,
+			opts:      options{hcRecursionDesired: true},
+		},
+	}
+}
+
+// upstreamOptions are the properties of a group's proxies and how they are queried.
+type upstreamOptions struct {
+	maxfails      uint32
+	tlsArgs       []string
+	tlsConfig     *tls.Config
+	tlsServerName string
+	expire        time.Duration
+	dohMethod     string
+	opts          options
+
+	set map[string]bool // the properties that were given, by name
+}
+
+// inherit returns o with the properties it doesn't set taken from parent.
+func (o upstreamOptions) inherit(parent upstreamOptions) upstreamOptions {
+	r := parent
+	r.set = nil
+	if o.set["max_fails"] {
+		r.maxfails = o.maxfails
+	}
+	if o.set["tls"] {
+		r.tlsArgs, r.tlsConfig = o.tlsArgs, o.tlsConfig
+	}
+	if o.set["tls_servername"] {
+		r.tlsServerName = o.tlsServerName
+	}
+	if o.set["expire"] {
+		r.expire = o.expire
+	}
+	if o.set["doh_method"] {
+		r.dohMethod = o.dohMethod
+	}
+	// force_tcp and prefer_udp are inherited together, so a group can prefer UDP when TCP is forced.
+	if o.set["force_tcp"] || o.set["prefer_udp"] {
+		r.opts.forceTCP, r.opts.preferUDP = o.opts.forceTCP, o.opts.preferUDP
+	}
+	if o.set["anti_poison"] {
+		r.opts.poison = o.opts.poison
+	}
+	return r
+}
+
+// copy returns a copy of o that can be parsed into without affecting o.
+func (o upstreamOptions) copy() upstreamOptions {
+	set := make(map[string]bool, len(o.set))
+	for name := range o.set {
+		set[name] = true
+	}
+	o.set = set
+	return o
+}
+
+// tls returns the TLS config for the proxies.
+func (o *upstreamOptions) tls() *tls.Config {
+	cfg := o.tlsConfig.Clone()
+	if o.tlsServerName != "" {
+		cfg.ServerName = o.tlsServerName
+	}
+	return cfg
+}
+
+// group returns the named group, creating it if it doesn't exist yet. While an upstream file is
+// applied a group starts out empty the first time the file mentions it, so the file replaces it.
+func (cfg *upstreamConfig) group(name string) *Group {
+	g, ok := cfg.groups[name]
+	if !ok || (cfg.fresh != nil && !cfg.fresh[name]) {
+		g = NewGroup(name)
+		cfg.groups[name] = g
+	}
+	if cfg.fresh != nil {
+		cfg.fresh[name] = true
+	}
+	return g
+}
+
+// clone returns a copy of cfg that can be changed without affecting cfg.
+func (cfg *upstreamConfig) clone() *upstreamConfig {
+	c := *cfg
+	c.upstreamOptions = cfg.upstreamOptions.copy()
+	c.fallbacks = make(map[string]string, len(cfg.fallbacks))
+	for from, to := range cfg.fallbacks {
+		c.fallbacks[from] = to
+	}
+	c.groups = make(map[string]*Group, len(cfg.groups))
+	for name, g := range cfg.groups {
+		c.groups[name] = g.copy()
+	}
+	return &c
+}
+
+// build creates the groups of cfg with their proxies. Proxies of old with the same key are reused.
+func (cfg *upstreamConfig) build(old *upstreams) *upstreams {
+	up := &upstreams{groups: make(map[string]*Group, len(cfg.groups)), proxies: make(map[string]*Proxy)}
+	for name, g := range cfg.groups {
+		bg := g.copy()
+		if bg.p == nil {
+			bg.p = cfg.p
+		}
+		bg.upstreamOptions = g.upstreamOptions.inherit(cfg.upstreamOptions)
+		tlsConfig := bg.tls()
+		for i, addr := range g.addrs {
+			trans := g.transports[i]
+			key := bg.key(addr, trans)
+			p, ok := up.proxies[key]
+			if !ok && old != nil {
+				p, ok = old.proxies[key]
+			}
+			if !ok {
+				p = NewProxy(addr, trans)
+				// Only set this for proxies that need it.
+				if trans == transport.TLS || trans == transport.HTTPS {
+					p.SetTLSConfig(tlsConfig)
+				}
+				p.SetExpire(bg.expire)
+				p.SetDoHMethod(bg.dohMethod)
+				if bg.via != nil {
+					p.SetDialProxy(bg.via)
+				}
+			}
+			up.proxies[key] = p
+			bg.proxies = append(bg.proxies, p)
+		}
+		up.groups[name] = bg
+	}
+	for from, to := range cfg.fallbacks {
+		if g, ok := up.groups[from]; ok {
+			g.next = up.groups[to]
+		}
+	}
+	for _, g := range up.groups {
+		if g.bogus != nil && g.bogus.action != bogusNXDomain && g.bogus.action != bogusRetry {
+			g.bogusGroup = up.groups[g.bogus.action]
+		}
+	}
+	return up
+}
+
+// checkFallbacks returns an error if a fallback refers to a group that is unknown or has no
+// upstreams, or if the fallbacks form a loop.
+func (cfg *upstreamConfig) checkFallbacks() error {
+	for from, to := range cfg.fallbacks {
+		if g, ok := cfg.groups[to]; !ok || g.Len() == 0 {
+			return fmt.Errorf("fallback from %s to unknown or empty group %q", from, to)
+		}
+		next, ok := to, true
+		for i := 0; ok && i < len(cfg.fallbacks); i++ {
+			if next == from {
+				return fmt.Errorf("fallbacks of group %s form a loop", from)
+			}
+			next, ok = cfg.fallbacks[next]
+		}
+	}
+	return nil
+}
+
+// upstreams is an immutable snapshot of the upstream groups. Like the rule set it is replaced as a
+// whole when the upstream file is reloaded.
+type upstreams struct {
+	groups   map[string]*Group
+	proxies  map[string]*Proxy // every proxy of every group, by key
+	checksum string            // of the upstream file it was built from
+}
+
+// upstream returns the active upstreams.
+func (b *Bypass) upstream() *upstreams { return b.up.Load().(*upstreams) }
+
+// clone returns a copy of up whose groups can be changed without affecting those of up.
+func (up *upstreams) clone() *upstreams {
+	c := &upstreams{
+		groups:   make(map[string]*Group, len(up.groups)),
+		proxies:  make(map[string]*Proxy, len(up.proxies)),
+		checksum: up.checksum,
+	}
+	for name, g := range up.groups {
+		ng := *g
+		ng.addrs = append([]string(nil), g.addrs...)
+		ng.transports = append([]string(nil), g.transports...)
+		ng.proxies = append([]*Proxy(nil), g.proxies...)
+		c.groups[name] = &ng
+	}
+	for _, g := range c.groups {
+		if g.next != nil {
+			g.next = c.groups[g.next.name]
+		}
+		if g.bogusGroup != nil {
+			g.bogusGroup = c.groups[g.bogusGroup.name]
+		}
+	}
+	for key, p := range up.proxies {
+		c.proxies[key] = p
+	}
+	return c
+}
+
+// loadUpstreams builds the groups from the Corefile and the upstream file, if any, and publishes
+// them. It returns the proxies that weren't in use before and those that no longer are. With start
+// set the added proxies are started before the groups are published.
+func (b *Bypass) loadUpstreams(start bool) (added, removed []*Proxy, err error) {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+	defer func() { countReload("upstreams", err) }()
+
+	cfg, csum := b.cfg, ""
+	if b.upstreamFile != "" {
+		sum, err := FileChecksum(b.upstreamFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		csum = string(sum)
+		if cfg, err = parseUpstreamFile(b.upstreamFile, b.cfg); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := cfg.checkFallbacks(); err != nil {
+		return nil, nil, err
+	}
+	old := b.upstream()
+	up := cfg.build(old)
+	if err := b.checkGroups(up.groups); err != nil {
+		return nil, nil, err
+	}
+	up.checksum = csum
+	for key, p := range up.proxies {
+		if _, ok := old.proxies[key]; !ok {
+			added = append(added, p)
+		}
+	}
+	for key, p := range old.proxies {
+		if _, ok := up.proxies[key]; !ok {
+			removed = append(removed, p)
+		}
+	}
+	if start {
+		for _, p := range added {
+			p.start(b.hcInterval)
+		}
+	}
+	b.up.Store(up)
+	log.Infof("Loaded %d upstream groups with %d proxies, %d new and %d removed", len(up.groups), len(up.proxies), len(added), len(removed))
+	return added, removed, nil
+}
+
+// reloadUpstreams loads the upstreams again if the upstream file changed. Added proxies are started
+// before the new groups are published and removed ones are closed after.
+func (b *Bypass) reloadUpstreams() {
+	if b.upstreamFile == "" {
+		return
+	}
+	csum, err := FileChecksum(b.upstreamFile)
+	if err != nil {
+		log.Warningf("Failed to check upstream file: %s", err)
+		return
+	}
+	if string(csum) == b.upstream().checksum {
+		return
+	}
+	_, removed, err := b.loadUpstreams(true)
+	if err != nil {
+		log.Warningf("Failed to reload upstreams, keeping the current ones: %s", err)
+		return
+	}
+	for _, p := range removed {
+		p.close()
+	}
+}
+
+// checkGroups returns an error if a route or default refers to a group that is unknown or has no
+// upstreams, if the pass group has none, if a group has too many upstreams, prefers UDP through
+// a proxy or has a name too long for its routing sets. The groups must be built.
+func (b *Bypass) checkGroups(groups map[string]*Group) error {
+	for _, g := range groups {
+		if g.Len() > max {
+			return fmt.Errorf("more than %d TOs configured in group %s: %d", max, g.name, g.Len())
+		}
+	}
+	for _, rt := range b.allRoutes() {
+		if rt.action != actionRoute {
+			continue
+		}
+		if g, ok := groups[rt.group]; !ok || g.Len() == 0 {
+			return fmt.Errorf("route to unknown or empty group %q", rt.group)
+		}
+	}
+	for _, g := range groups {
+		if g.via != nil && g.opts.preferUDP {
+			return fmt.Errorf("group %s dials through proxy %s, which only carries TCP: prefer_udp can't be used", g.name, g.via)
+		}
+		if g.bogus == nil || g.bogus.action == bogusNXDomain || g.bogus.action == bogusRetry {
+			continue
+		}
+		bg := g.bogusGroup
+		if bg == nil || bg.Len() == 0 {
+			return fmt.Errorf("bogus_ip of group %s sends to unknown or empty group %q", g.name, g.bogus.action)
+		}
+		if bg.bogusGroup != nil || bg == g {
+			return fmt.Errorf("bogus_ip of group %s sends to group %s, which sends bogus answers on itself", g.name, bg.name)
+		}
+	}
+	defs := []string{b.def}
+	for _, cr := range b.clients {
+		if cr.def != "" {
+			defs = append(defs, cr.def)
+		}
+	}
+	for _, def := range defs {
+		if g, ok := groups[def]; !ok || g.Len() == 0 {
+			return fmt.Errorf("default group %q is unknown or empty", def)
+		}
+	}
+	// Queries for the zone apex go to pass, and verify and race ask it along with the default group.
+	if g, ok := groups[passGroup]; !ok || g.Len() == 0 {
+		return fmt.Errorf("group %s is unknown or empty", passGroup)
+	}
+	if b.sets != nil {
+		return b.sets.check(groups)
+	}
+	return nil
+}
+
+// parseUpstreamFile applies the upstream properties in the file at path to a copy of cfg:
+//
+//	pass TO...
+//	forward TO...
+//	group NAME [TO...] { ... }
+//	fallback GROUP -> GROUP...
+//	policy, max_fails, tls, tls_servername, expire, doh_method, force_tcp, prefer_udp, anti_poison
+//
+// A group the file mentions replaces the group of the same name in cfg, other properties override
+// those of cfg.
+func parseUpstreamFile(path string, cfg *upstreamConfig) (*upstreamConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg = cfg.clone()
+	cfg.fresh = make(map[string]bool)
+	c := caddyfile.NewDispenser(path, f)
+	for c.Next() {
+		if err := parseUpstream(&c, cfg); err != nil {
+			return nil, err
+		}
+	}
+	cfg.fresh = nil
+	return cfg, nil
+}
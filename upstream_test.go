@@ -0,0 +1,244 @@
+package bypass
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamFileReusesProxies(t *testing.T) {
+	cfg := newUpstreamConfig()
+	if err := cfg.group(passGroup).add("127.0.0.1:5301"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.group(forwardGroup).add("127.0.0.1:5302", "127.0.0.1:5303"); err != nil {
+		t.Fatal(err)
+	}
+	old := cfg.build(nil)
+
+	f, err := ioutil.TempFile("", "upstreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("forward 127.0.0.1:5303 127.0.0.1:5304\npolicy sequential\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	next, err := parseUpstreamFile(f.Name(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := cfg.groups[forwardGroup].Len(); n != 2 {
+		t.Errorf("Corefile config changed, forward has %d upstreams", n)
+	}
+	up := next.build(old)
+
+	fwd := up.groups[forwardGroup]
+	if fwd.Len() != 2 || fwd.proxies[0].addr != "127.0.0.1:5303" || fwd.proxies[1].addr != "127.0.0.1:5304" {
+		t.Fatalf("forward group not replaced: %v", fwd.addrs)
+	}
+	if fwd.proxies[0] != old.groups[forwardGroup].proxies[1] {
+		t.Error("unchanged forward proxy was not reused")
+	}
+	if up.groups[passGroup].proxies[0] != old.groups[passGroup].proxies[0] {
+		t.Error("pass proxy was not reused")
+	}
+	if _, ok := fwd.p.(*sequential); !ok {
+		t.Errorf("policy not overridden: %T", fwd.p)
+	}
+}
+
+// parseUpstreams parses upstream properties from input.
+func parseUpstreams(input string) (*upstreamConfig, error) {
+	cfg := newUpstreamConfig()
+	c := caddyfile.NewDispenser("test", strings.NewReader(input))
+	for c.Next() {
+		if err := parseUpstream(&c, cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func TestGroupUpstreamOptions(t *testing.T) {
+	cfg, err := parseUpstreams(`pass 127.0.0.1:5301
+max_fails 3
+force_tcp
+group forward tls://8.8.8.8 tls://8.8.4.4 {
+    tls
+    tls_servername dns.google
+    expire 30s
+    max_fails 0
+}
+group domestic 127.0.0.1:5302 {
+    prefer_udp
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := cfg.build(nil)
+
+	pass, fwd, dom := up.groups[passGroup], up.groups[forwardGroup], up.groups["domestic"]
+	if pass.maxfails != 3 || !pass.opts.forceTCP || pass.proxies[0].transport.tlsConfig != nil {
+		t.Errorf("pass group doesn't use the plugin's options")
+	}
+	if fwd.maxfails != 0 || !fwd.opts.forceTCP {
+		t.Errorf("forward group options not applied: max_fails %d", fwd.maxfails)
+	}
+	for _, p := range fwd.proxies {
+		if tc := p.transport.tlsConfig; tc == nil || tc.ServerName != "dns.google" {
+			t.Errorf("proxy %s has TLS config %v", p.addr, tc)
+		}
+		if p.transport.expire != 30*time.Second {
+			t.Errorf("proxy %s expires after %s", p.addr, p.transport.expire)
+		}
+	}
+	if !dom.opts.preferUDP || dom.opts.forceTCP || dom.maxfails != 3 {
+		t.Errorf("domestic group got %+v, max_fails %d", dom.opts, dom.maxfails)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	// Nothing listens on dead, so queries to it fail right away.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := pc.LocalAddr().String()
+	pc.Close()
+
+	pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	for _, input := range []string{
+		"pass 127.0.0.1:53\nfallback pass -> forward\n",
+		"pass 127.0.0.1:53\nforward 127.0.0.1:53\nfallback pass -> forward -> pass\n",
+	} {
+		cfg, err := parseUpstreams(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.checkFallbacks(); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+	if _, err := parseUpstreams("fallback pass forward\n"); err == nil {
+		t.Error("expected syntax error")
+	}
+
+	cfg, err := parseUpstreams("pass " + dead + "\nforward " + pc.LocalAddr().String() + "\nfallback pass -> forward\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.checkFallbacks(); err != nil {
+		t.Fatal(err)
+	}
+	b := New()
+	up := cfg.build(nil)
+	b.up.Store(up)
+	for _, p := range up.proxies {
+		p.start(hcInterval)
+		defer p.close()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+	start := time.Now()
+	ret, from, _, err := b.resolve(context.Background(), state, up.groups[passGroup], defaultTimeout)
+	if err != nil || ret.Id != m.Id || from.name != forwardGroup {
+		t.Fatalf("expected an answer from the forward group, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("fallback took %s", d)
+	}
+}
+
+func TestSetGroupPublishesCopy(t *testing.T) {
+	b := New()
+	b.SetPass(NewProxy("127.0.0.1:5301", transport.DNS))
+	old := b.upstream()
+	b.SetPass(NewProxy("127.0.0.1:5302", transport.DNS))
+	defer func() {
+		for _, p := range b.upstream().proxies {
+			p.close()
+		}
+	}()
+
+	if n := old.groups[passGroup].Len(); n != 1 || len(old.proxies) != 1 {
+		t.Errorf("published upstreams changed: pass has %d upstreams", n)
+	}
+	if n := b.LenPass(); n != 2 {
+		t.Errorf("pass has %d upstreams, want 2", n)
+	}
+}
+
+func TestUpstreamFileEmptyPass(t *testing.T) {
+	f, err := ioutil.TempFile("", "upstreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	empty := "group pass {\n    max_fails 3\n}\n"
+	if _, err := f.WriteString(empty); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	corefile := `bypass . 127.0.0.1:5301 {
+    forward 127.0.0.1:5302
+    upstreams ` + f.Name() + `
+}`
+	if _, err := parseBypass(caddy.NewTestController("dns", corefile)); err == nil {
+		t.Fatal("expected error for an empty pass group")
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("max_fails 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := parseBypass(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.Name(), []byte(empty), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.reloadUpstreams()
+	if n := b.LenPass(); n != 1 {
+		t.Errorf("reload with an empty pass group published %d pass upstreams", n)
+	}
+}
+
+func TestExchangeEmptyGroup(t *testing.T) {
+	b := New()
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+	g := NewGroup("empty")
+	g.p = &random{}
+	if _, _, _, err := b.exchange(context.Background(), state, g, defaultTimeout); err != ErrNoHealthy {
+		t.Errorf("got %v, want %v", err, ErrNoHealthy)
+	}
+}
@@ -0,0 +1,15 @@
+package bypass
+
+import (
+	"errors"
+)
+
+// watcher notifies about changes to a set of files.
+type watcher interface {
+	// changes receives a value after one or more of the files changed.
+	changes() <-chan struct{}
+	close() error
+}
+
+// errWatchUnsupported is returned by newWatcher on platforms without file notifications.
+var errWatchUnsupported = errors.New("file notifications not supported on this platform")
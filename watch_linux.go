@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+package bypass
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask selects the inotify events on a directory that may change one of its files, including
+// a new file renamed over the old one.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM
+
+// inotifyWatcher watches the directories of the files rather than the files themselves, so it keeps
+// working when a file is replaced by an atomic rename.
+type inotifyWatcher struct {
+	f     *os.File
+	dirs  map[int32]string // watch descriptor -> directory
+	files map[string]bool
+	c     chan struct{}
+}
+
+// newWatcher returns a watcher for files using inotify.
+func newWatcher(files []string) (watcher, error) {
+	// A non-blocking descriptor is handled by the runtime poller, which lets close interrupt a read.
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{
+		f:     os.NewFile(uintptr(fd), "inotify"),
+		dirs:  make(map[int32]string),
+		files: make(map[string]bool),
+		c:     make(chan struct{}, 1),
+	}
+	watched := make(map[string]bool)
+	for _, file := range files {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			w.f.Close()
+			return nil, err
+		}
+		w.files[path] = true
+		dir := filepath.Dir(path)
+		if watched[dir] {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, watchMask)
+		if err != nil {
+			w.f.Close()
+			return nil, os.NewSyscallError("inotify_add_watch", err)
+		}
+		watched[dir] = true
+		w.dirs[int32(wd)] = dir
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotifyWatcher) changes() <-chan struct{} { return w.c }
+
+func (w *inotifyWatcher) close() error { return w.f.Close() }
+
+// run reads events until the watcher is closed.
+func (w *inotifyWatcher) run() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			path := filepath.Join(w.dirs[ev.Wd], strings.TrimRight(string(name), "\x00"))
+			// On queue overflow we lost events and can't tell what changed.
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 || w.files[path] {
+				w.notify()
+			}
+		}
+	}
+}
+
+// notify signals a change without blocking; pending changes are coalesced.
+func (w *inotifyWatcher) notify() {
+	select {
+	case w.c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package bypass
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInotifyWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bypass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.txt")
+	if err := ioutil.WriteFile(path, []byte("example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newWatcher([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	expect := func(what string, changed bool) {
+		t.Helper()
+		select {
+		case <-w.changes():
+			if !changed {
+				t.Errorf("%s: unexpected change", what)
+			}
+			// A single write may send several events, let them coalesce.
+			time.Sleep(50 * time.Millisecond)
+			select {
+			case <-w.changes():
+			default:
+			}
+		case <-time.After(200 * time.Millisecond):
+			if changed {
+				t.Errorf("%s: no change", what)
+			}
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("other file", false)
+
+	if err := ioutil.WriteFile(path, []byte("example.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("write", true)
+
+	tmp := filepath.Join(dir, ".rules.txt.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("example.net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("temporary file", false)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	expect("rename", true)
+}
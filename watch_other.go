@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package bypass
+
+// newWatcher is not supported here, rule files are only polled.
+func newWatcher(files []string) (watcher, error) { return nil, errWatchUnsupported }